@@ -0,0 +1,707 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AdObject is a user, group, computer or domain of a BloodHound
+// collection, Name is the upper cased NAME@DOMAIN or computer fqdn.
+type AdObject struct {
+	gorm.Model
+	Sid         string `gorm:"size:128;uniqueIndex"`
+	Kind        string `gorm:"size:16;index"`
+	Name        string `gorm:"size:255;index"`
+	Domain      string `gorm:"size:255"`
+	SamName     string `gorm:"size:255;index"`
+	Enabled     bool
+	Description string
+	OS          string
+	HostID      *uint `gorm:"index"`
+	Properties  datatypes.JSON
+}
+
+type AdMember struct {
+	gorm.Model
+	GroupSid   string `gorm:"size:128;index"`
+	MemberSid  string `gorm:"size:128;index"`
+	MemberKind string `gorm:"size:16"`
+}
+
+// AdSession is a logged on user seen on a computer, Source is session,
+// privileged or registry.
+type AdSession struct {
+	gorm.Model
+	ComputerSid string `gorm:"size:128;index"`
+	UserSid     string `gorm:"size:128;index"`
+	Source      string `gorm:"size:16"`
+}
+
+type bhRef struct {
+	ObjectIdentifier string
+	ObjectType       string
+	MemberId         string
+	MemberType       string
+}
+
+type bhSession struct {
+	UserSID     string
+	ComputerSID string
+	UserId      string
+	ComputerId  string
+}
+
+// bhObject covers the SharpHound 3 and 4 layouts, sessions are a plain list
+// in the former and a {Results: [...]} object in the latter.
+type bhObject struct {
+	ObjectIdentifier   string
+	Properties         map[string]any
+	Members            []bhRef
+	Sessions           json.RawMessage
+	PrivilegedSessions json.RawMessage
+	RegistrySessions   json.RawMessage
+	LocalAdmins        json.RawMessage
+	Trusts             json.RawMessage
+}
+
+func bhSessions(raw json.RawMessage) []bhSession {
+	var list []bhSession
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var res struct{ Results []bhSession }
+	json.Unmarshal(raw, &res)
+	return res.Results
+}
+
+func bhString(props map[string]any, key string) string {
+	s, _ := props[key].(string)
+	return s
+}
+
+// bhTypeKind maps a SharpHound type, meta.type since SharpHound 4 or the
+// list key before, to the kind stored, the other types are skipped.
+func bhTypeKind(t string) string {
+	switch strings.ToLower(t) {
+	case "users":
+		return "user"
+	case "groups":
+		return "group"
+	case "computers":
+		return "computer"
+	case "domains":
+		return "domain"
+	}
+	return ""
+}
+
+// bhKind tells the kind of an object from its fields, for files without
+// meta.
+func bhKind(o *bhObject) string {
+	switch {
+	case o.Members != nil:
+		return "group"
+	case o.Sessions != nil || o.LocalAdmins != nil:
+		return "computer"
+	case o.Trusts != nil:
+		return "domain"
+	}
+	return "user"
+}
+
+type adImport struct {
+	sids     map[string]bool
+	Objects  []AdObject
+	Groups   []string
+	Members  []AdMember
+	Hosts    []string
+	Sessions []AdSession
+}
+
+// read streams the objects of a BloodHound json file, they are under data
+// since SharpHound 4 and under the kind (users, computers...) before. The
+// meta object with the type of the data comes last, the data is held until
+// then.
+func (imp *adImport) read(name string, src io.Reader) error {
+	dec := json.NewDecoder(src)
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("unable to parse %s %v", name, err)
+	}
+	var meta struct{ Type string }
+	var data []bhObject
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("unable to parse %s %v", name, err)
+		}
+		if key == "meta" {
+			if err := dec.Decode(&meta); err != nil {
+				return fmt.Errorf("unable to parse %s %v", name, err)
+			}
+			continue
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("unable to parse %s %v", name, err)
+		}
+		if tok != json.Delim('[') {
+			if tok == json.Delim('{') {
+				for depth := 1; depth > 0; {
+					if tok, err = dec.Token(); err != nil {
+						return fmt.Errorf("unable to parse %s %v", name, err)
+					}
+					switch tok {
+					case json.Delim('{'), json.Delim('['):
+						depth++
+					case json.Delim('}'), json.Delim(']'):
+						depth--
+					}
+				}
+			}
+			continue
+		}
+		for dec.More() {
+			var o bhObject
+			if err := dec.Decode(&o); err != nil {
+				return fmt.Errorf("unable to parse %s %v", name, err)
+			}
+			if key == "data" {
+				data = append(data, o)
+			} else {
+				imp.add(bhTypeKind(fmt.Sprint(key)), &o)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("unable to parse %s %v", name, err)
+		}
+	}
+	for i := range data {
+		kind := bhTypeKind(meta.Type)
+		if meta.Type == "" {
+			kind = bhKind(&data[i])
+		}
+		imp.add(kind, &data[i])
+	}
+	return nil
+}
+
+// add records an object of kind, the objects of a sid already seen in the
+// upload are skipped so a batch never updates the same row twice.
+func (imp *adImport) add(kind string, o *bhObject) {
+	sid := o.ObjectIdentifier
+	if sid == "" {
+		sid = bhString(o.Properties, "objectid")
+	}
+	if kind == "" || sid == "" || imp.sids[sid] {
+		return
+	}
+	if imp.sids == nil {
+		imp.sids = make(map[string]bool)
+	}
+	imp.sids[sid] = true
+	props, _ := json.Marshal(o.Properties)
+	enabled, _ := o.Properties["enabled"].(bool)
+	obj := AdObject{
+		Sid:         sid,
+		Kind:        kind,
+		Name:        strings.ToUpper(bhString(o.Properties, "name")),
+		Domain:      strings.ToUpper(bhString(o.Properties, "domain")),
+		SamName:     strings.ToLower(bhString(o.Properties, "samaccountname")),
+		Enabled:     enabled,
+		Description: bhString(o.Properties, "description"),
+		OS:          bhString(o.Properties, "operatingsystem"),
+		Properties:  props,
+	}
+	if obj.Name == "" {
+		obj.Name = sid
+	}
+	imp.Objects = append(imp.Objects, obj)
+
+	switch kind {
+	case "group":
+		imp.Groups = append(imp.Groups, sid)
+		for _, m := range o.Members {
+			member, memberKind := m.ObjectIdentifier, m.ObjectType
+			if member == "" {
+				member, memberKind = m.MemberId, m.MemberType
+			}
+			if member != "" {
+				imp.Members = append(imp.Members, AdMember{GroupSid: sid, MemberSid: member, MemberKind: strings.ToLower(memberKind)})
+			}
+		}
+	case "computer":
+		imp.Hosts = append(imp.Hosts, sid)
+		for source, raw := range map[string]json.RawMessage{"session": o.Sessions, "privileged": o.PrivilegedSessions, "registry": o.RegistrySessions} {
+			for _, s := range bhSessions(raw) {
+				user := s.UserSID
+				if user == "" {
+					user = s.UserId
+				}
+				if user != "" {
+					imp.Sessions = append(imp.Sessions, AdSession{ComputerSid: sid, UserSid: user, Source: source})
+				}
+			}
+		}
+	}
+}
+
+// applyScope goes through the computers with their dns name and address,
+// the sessions and memberships of the rejected ones are dropped with them.
+func (imp *adImport) applyScope(db *gorm.DB, filter *scopeFilter) error {
+	resolver := newNameResolver(db)
+	dropped := make(map[string]bool)
+	var objects []AdObject
+	for _, o := range imp.Objects {
+		if o.Kind == "computer" {
+			name := strings.ToLower(o.Name)
+			ip, err := resolver.IP(name)
+			if err != nil {
+				return err
+			}
+			if !filter.Keep(name, ip, name) {
+				dropped[o.Sid] = true
+				continue
+			}
+		}
+		objects = append(objects, o)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	imp.Objects = objects
+	var hosts []string
+	for _, sid := range imp.Hosts {
+		if !dropped[sid] {
+			hosts = append(hosts, sid)
+		}
+	}
+	imp.Hosts = hosts
+	var sessions []AdSession
+	for _, s := range imp.Sessions {
+		if !dropped[s.ComputerSid] {
+			sessions = append(sessions, s)
+		}
+	}
+	imp.Sessions = sessions
+	var members []AdMember
+	for _, m := range imp.Members {
+		if !dropped[m.MemberSid] {
+			members = append(members, m)
+		}
+	}
+	imp.Members = members
+	return nil
+}
+
+// save replaces the objects of the import along with the memberships of
+// its groups and the sessions of its computers.
+func (imp *adImport) save(db *gorm.DB) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(imp.Objects) > 0 {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "sid"}},
+				DoUpdates: clause.AssignmentColumns([]string{"updated_at", "deleted_at", "kind", "name", "domain", "sam_name", "enabled", "description", "os", "properties"}),
+			}).CreateInBatches(imp.Objects, 200).Error
+			if err != nil {
+				return err
+			}
+		}
+		for groups := imp.Groups; len(groups) > 0; {
+			n := min(len(groups), 500)
+			if err := tx.Unscoped().Where("group_sid IN ?", groups[:n]).Delete(&AdMember{}).Error; err != nil {
+				return err
+			}
+			groups = groups[n:]
+		}
+		for hosts := imp.Hosts; len(hosts) > 0; {
+			n := min(len(hosts), 500)
+			if err := tx.Unscoped().Where("computer_sid IN ?", hosts[:n]).Delete(&AdSession{}).Error; err != nil {
+				return err
+			}
+			hosts = hosts[n:]
+		}
+		if len(imp.Members) > 0 {
+			if err := tx.CreateInBatches(imp.Members, 500).Error; err != nil {
+				return err
+			}
+		}
+		if len(imp.Sessions) > 0 {
+			if err := tx.CreateInBatches(imp.Sessions, 500).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return linkAdComputers(db)
+}
+
+// linkAdComputers points the computers to the host of their dns name, from
+// the dns inventory or the nmap hostname.
+func linkAdComputers(db *gorm.DB) error {
+	return db.Model(&AdObject{}).Where("kind = ?", "computer").
+		Update("host_id", gorm.Expr("COALESCE((SELECT dns_records.host_id FROM dns_records WHERE dns_records.name = LOWER(ad_objects.name) AND dns_records.host_id IS NOT NULL AND dns_records.deleted_at IS NULL LIMIT 1), (SELECT hosts.id FROM hosts WHERE LOWER(hosts.hostname) = LOWER(ad_objects.name) AND hosts.deleted_at IS NULL LIMIT 1))")).Error
+}
+
+// findAdObject looks an object up by sid, full name, name without domain or
+// account name.
+func findAdObject(db *gorm.DB, name string) (*AdObject, error) {
+	var obj AdObject
+	upper := strings.ToUpper(name)
+	res := db.Where("sid = ? OR name = ? OR sam_name = ?", name, upper, strings.ToLower(name)).Limit(1).Find(&obj)
+	if res.Error == nil && res.RowsAffected == 0 {
+		res = db.Where("name LIKE ?", upper+"@%").Or("name LIKE ?", upper+".%").Order("name").Limit(1).Find(&obj)
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &obj, nil
+}
+
+func adObjectsBySid(db *gorm.DB, sids []string) (map[string]AdObject, error) {
+	res := make(map[string]AdObject)
+	for len(sids) > 0 {
+		n := min(len(sids), 500)
+		var objs []AdObject
+		if err := db.Omit("properties").Where("sid IN ?", sids[:n]).Find(&objs).Error; err != nil {
+			return nil, err
+		}
+		for _, o := range objs {
+			res[o.Sid] = o
+		}
+		sids = sids[n:]
+	}
+	return res, nil
+}
+
+type adMembership struct {
+	Sid string
+	Via string
+}
+
+// adGroupMembers expands the members of a group through nested groups, Via
+// is the group a member was found in.
+func adGroupMembers(db *gorm.DB, group string) ([]adMembership, error) {
+	seen := map[string]bool{group: true}
+	var res []adMembership
+	for next := []string{group}; len(next) > 0; {
+		var members []AdMember
+		if err := db.Where("group_sid IN ?", next).Find(&members).Error; err != nil {
+			return nil, err
+		}
+		next = nil
+		for _, m := range members {
+			if seen[m.MemberSid] {
+				continue
+			}
+			seen[m.MemberSid] = true
+			res = append(res, adMembership{Sid: m.MemberSid, Via: m.GroupSid})
+			if m.MemberKind == "group" {
+				next = append(next, m.MemberSid)
+			}
+		}
+	}
+	return res, nil
+}
+
+// adMemberOf returns the groups sid belongs to, directly or through nested
+// groups.
+func adMemberOf(db *gorm.DB, sid string) ([]adMembership, error) {
+	seen := map[string]bool{sid: true}
+	var res []adMembership
+	for next := []string{sid}; len(next) > 0; {
+		var members []AdMember
+		if err := db.Where("member_sid IN ?", next).Find(&members).Error; err != nil {
+			return nil, err
+		}
+		next = nil
+		for _, m := range members {
+			if seen[m.GroupSid] {
+				continue
+			}
+			seen[m.GroupSid] = true
+			res = append(res, adMembership{Sid: m.GroupSid, Via: m.MemberSid})
+			next = append(next, m.GroupSid)
+		}
+	}
+	return res, nil
+}
+
+func adName(objs map[string]AdObject, sid string) string {
+	if o, ok := objs[sid]; ok {
+		return o.Name
+	}
+	return sid
+}
+
+func adHostIP(db *gorm.DB, o *AdObject) string {
+	if o.HostID == nil {
+		return ""
+	}
+	var ips []string
+	db.Model(&Host{}).Where("id = ?", *o.HostID).Limit(1).Pluck("ip", &ips)
+	if len(ips) == 0 {
+		return ""
+	}
+	return ips[0]
+}
+
+// adMacro renders [[ad:NAME]] as a link to the object.
+func adMacro(arg string) string {
+	name := strings.TrimSpace(arg)
+	obj, err := findAdObject(database, name)
+	if err != nil {
+		return fmt.Sprintf("`%s` (not found)", name)
+	}
+	return fmt.Sprintf("[%s](/nmap/ad/object/%s) (%s)", obj.Name, url.PathEscape(obj.Sid), obj.Kind)
+}
+
+func AdRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/ad/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] AD UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		spool, err := os.CreateTemp("", "wikix-ad-*")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		size, err := io.Copy(spool, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		imp := &adImport{}
+		magic := make([]byte, 4)
+		spool.ReadAt(magic, 0)
+		if string(magic) == "PK\x03\x04" {
+			zr, err := zip.NewReader(spool, size)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("unable to read zip %v", err), http.StatusBadRequest)
+				return
+			}
+			for _, f := range zr.File {
+				if strings.ToLower(path.Ext(f.Name)) != ".json" {
+					continue
+				}
+				rc, err := f.Open()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				err = imp.read(f.Name, rc)
+				rc.Close()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := imp.read(r.URL.Query().Get("name"), io.NewSectionReader(spool, 0, size)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter, err := newScopeFilter(db, w, r.URL.Query().Get("scope") == "reject")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := imp.applyScope(db, filter); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := imp.save(db); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("%d objects, %d memberships, %d sessions \nOK\n", len(imp.Objects), len(imp.Members), len(imp.Sessions))))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/ad", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		tx := db.Omit("properties").Order("kind, name")
+		if s := r.URL.Query().Get("q"); s != "" {
+			tx = tx.Where("name LIKE ? OR sam_name LIKE ? OR description LIKE ?", "%"+strings.ToUpper(s)+"%", "%"+strings.ToLower(s)+"%", "%"+s+"%")
+		}
+		if s := r.URL.Query().Get("kind"); s != "" {
+			tx = tx.Where("kind = ?", s)
+		}
+		var objs []AdObject
+		if err := tx.Find(&objs).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, o := range objs {
+			res = res + fmt.Sprintf("%s\t%s\t%s\t%s\n", o.Kind, o.Name, o.Sid, o.Description)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/ad/members/{group}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		group, err := findAdObject(db, mux.Vars(r)["group"])
+		if err != nil {
+			dbError(w, err, "group")
+			return
+		}
+		members, err := adGroupMembers(db, group.Sid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sids := []string{group.Sid}
+		for _, m := range members {
+			sids = append(sids, m.Sid, m.Via)
+		}
+		objs, err := adObjectsBySid(db, sids)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.SliceStable(members, func(i, j int) bool { return adName(objs, members[i].Sid) < adName(objs, members[j].Sid) })
+		res := ""
+		for _, m := range members {
+			via := ""
+			if m.Via != group.Sid {
+				via = "\tvia " + adName(objs, m.Via)
+			}
+			res = res + fmt.Sprintf("%s\t%s%s\n", objs[m.Sid].Kind, adName(objs, m.Sid), via)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/ad/sessions/{user}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		user, err := findAdObject(db, mux.Vars(r)["user"])
+		if err != nil {
+			dbError(w, err, "user")
+			return
+		}
+		var sessions []AdSession
+		if err := db.Where("user_sid = ?", user.Sid).Find(&sessions).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var sids []string
+		for _, s := range sessions {
+			sids = append(sids, s.ComputerSid)
+		}
+		objs, err := adObjectsBySid(db, sids)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.SliceStable(sessions, func(i, j int) bool {
+			return adName(objs, sessions[i].ComputerSid) < adName(objs, sessions[j].ComputerSid)
+		})
+		res := ""
+		for _, s := range sessions {
+			computer := objs[s.ComputerSid]
+			res = res + fmt.Sprintf("%s\t%s\t%s\n", adName(objs, s.ComputerSid), adHostIP(db, &computer), s.Source)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/ad/object/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		obj, err := findAdObject(db, mux.Vars(r)["name"])
+		if err != nil {
+			dbError(w, err, "object")
+			return
+		}
+		res := fmt.Sprintf("%s\t%s\nsid\t%s\n", obj.Kind, obj.Name, obj.Sid)
+		if obj.SamName != "" {
+			res = res + fmt.Sprintf("account\t%s\n", obj.SamName)
+		}
+		res = res + fmt.Sprintf("enabled\t%v\n", obj.Enabled)
+		if obj.Description != "" {
+			res = res + fmt.Sprintf("description\t%s\n", obj.Description)
+		}
+		if obj.OS != "" {
+			res = res + fmt.Sprintf("os\t%s\n", obj.OS)
+		}
+		if ip := adHostIP(db, obj); ip != "" {
+			res = res + fmt.Sprintf("host\t%s /nmap/host/%s\n", ip, ip)
+		}
+
+		groups, err := adMemberOf(db, obj.Sid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var members []adMembership
+		if obj.Kind == "group" {
+			if members, err = adGroupMembers(db, obj.Sid); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		var sessions []AdSession
+		if err := db.Where("user_sid = ? OR computer_sid = ?", obj.Sid, obj.Sid).Find(&sessions).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var sids []string
+		for _, m := range append(groups, members...) {
+			sids = append(sids, m.Sid, m.Via)
+		}
+		for _, s := range sessions {
+			sids = append(sids, s.UserSid, s.ComputerSid)
+		}
+		objs, err := adObjectsBySid(db, sids)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(groups) > 0 {
+			res = res + "\nmember of\n"
+			for _, g := range groups {
+				via := ""
+				if g.Via != obj.Sid {
+					via = " (via " + adName(objs, g.Via) + ")"
+				}
+				res = res + fmt.Sprintf("\t%s%s\n", adName(objs, g.Sid), via)
+			}
+		}
+		if len(members) > 0 {
+			res = res + "\nmembers\n"
+			for _, m := range members {
+				res = res + fmt.Sprintf("\t%s %s\n", objs[m.Sid].Kind, adName(objs, m.Sid))
+			}
+		}
+		if len(sessions) > 0 {
+			res = res + "\nsessions\n"
+			for _, s := range sessions {
+				if s.UserSid == obj.Sid {
+					res = res + fmt.Sprintf("\ton %s (%s)\n", adName(objs, s.ComputerSid), s.Source)
+				} else {
+					res = res + fmt.Sprintf("\t%s (%s)\n", adName(objs, s.UserSid), s.Source)
+				}
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdImportRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		objects  map[string]string
+		members  int
+		sessions int
+	}{
+		{
+			name: "sharphound 3",
+			files: []string{
+				`{"computers":[{"Properties":{"name":"WS01.CORP.LOCAL","objectid":"S-1-5-21-1-1001"},"Sessions":[{"UserId":"S-1-5-21-1-500","ComputerId":"S-1-5-21-1-1001"}],"LocalAdmins":[]}],"meta":{"type":"computers","count":1}}`,
+				`{"groups":[{"Properties":{"name":"DOMAIN ADMINS@CORP.LOCAL","objectid":"S-1-5-21-1-512"},"Members":[{"MemberId":"S-1-5-21-1-500","MemberType":"User"}]}],"meta":{"type":"groups","count":1}}`,
+			},
+			objects:  map[string]string{"S-1-5-21-1-1001": "computer", "S-1-5-21-1-512": "group"},
+			members:  1,
+			sessions: 1,
+		},
+		{
+			name: "sharphound 4 with meta last",
+			files: []string{
+				`{"data":[{"ObjectIdentifier":"S-1-5-21-1-1001","Properties":{"name":"WS01.CORP.LOCAL"},"Sessions":{"Results":[{"UserSID":"S-1-5-21-1-500","ComputerSID":"S-1-5-21-1-1001"}],"Collected":true},"PrivilegedSessions":{"Results":[{"UserSID":"S-1-5-21-1-501"}]}}],"meta":{"type":"computers","version":5}}`,
+				`{"data":[{"ObjectIdentifier":"S-1-5-21-1-500","Properties":{"name":"ADMINISTRATOR@CORP.LOCAL","enabled":true}}],"meta":{"type":"users"}}`,
+				`{"data":[{"ObjectIdentifier":"{GPO-1}","Properties":{"name":"DEFAULT DOMAIN POLICY@CORP.LOCAL"}}],"meta":{"type":"gpos"}}`,
+			},
+			objects:  map[string]string{"S-1-5-21-1-1001": "computer", "S-1-5-21-1-500": "user"},
+			sessions: 2,
+		},
+		{
+			name: "no meta and duplicate sids",
+			files: []string{
+				`{"data":[{"ObjectIdentifier":"S-1-5-21-1-512","Members":[{"ObjectIdentifier":"S-1-5-21-1-500","ObjectType":"User"}]},{"ObjectIdentifier":"S-1-5-21-1-512","Members":[]},{"ObjectIdentifier":"S-1-5-21-1-100","Trusts":[]}]}`,
+			},
+			objects: map[string]string{"S-1-5-21-1-512": "group", "S-1-5-21-1-100": "domain"},
+			members: 1,
+		},
+	}
+	for _, tt := range tests {
+		imp := &adImport{}
+		for i, f := range tt.files {
+			if err := imp.read(tt.name, strings.NewReader(f)); err != nil {
+				t.Fatalf("%s file %d: %v", tt.name, i, err)
+			}
+		}
+		got := make(map[string]string)
+		for _, o := range imp.Objects {
+			got[o.Sid] = o.Kind
+		}
+		if len(got) != len(imp.Objects) || len(got) != len(tt.objects) {
+			t.Errorf("%s: objects %v, want %v", tt.name, got, tt.objects)
+		}
+		for sid, kind := range tt.objects {
+			if got[sid] != kind {
+				t.Errorf("%s: %s is %q, want %q", tt.name, sid, got[sid], kind)
+			}
+		}
+		if len(imp.Members) != tt.members {
+			t.Errorf("%s: %d members, want %d", tt.name, len(imp.Members), tt.members)
+		}
+		if len(imp.Sessions) != tt.sessions {
+			t.Errorf("%s: %d sessions, want %d", tt.name, len(imp.Sessions), tt.sessions)
+		}
+	}
+}
+
+func TestAdImportReadInvalid(t *testing.T) {
+	imp := &adImport{}
+	if err := imp.read("broken.json", strings.NewReader(`{"data":[{"ObjectIdentifier":`)); err == nil {
+		t.Error("truncated file accepted")
+	}
+}
@@ -65,8 +65,11 @@ func tarFiles() ([]string, error) {
 		return nil, err
 	}
 
-	if err := filepath.Walk(config["gorm"], addFile); err != nil {
-		log.Printf("ERROR no gorm database")
+	// a shared postgres or mysql database is backed up on its own
+	if config["gorm"] != "" {
+		if err := filepath.Walk(config["gorm"], addFile); err != nil {
+			log.Printf("ERROR no gorm database")
+		}
 	}
 
 	return files, nil
@@ -98,6 +101,13 @@ func CreateTarball(filePaths []string) (bytes.Buffer, error) {
 }
 
 func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	// fold the WAL back into gorm.db so the archived file is complete
+	if config["gorm"] != "" {
+		if err := database.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error; err != nil {
+			http.Error(w, fmt.Sprintf("Error checkpointing database : %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
 	files, err := tarFiles()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error enumerating files for backup : %v", err), http.StatusInternalServerError)
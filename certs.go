@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type Cert struct {
+	gorm.Model
+	IP          string `gorm:"size:64;index"`
+	Port        uint
+	Source      string
+	Fingerprint string
+	Subject     string
+	CommonName  string
+	Issuer      string
+	Sans        string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	KeyType     string
+	KeyBits     int
+	SigAlg      string
+	SelfSigned  bool
+}
+
+func (c *Cert) Expired() bool {
+	return !c.NotAfter.IsZero() && c.NotAfter.Before(time.Now())
+}
+
+func (c *Cert) Weak() bool {
+	sig := strings.ToLower(c.SigAlg)
+	if strings.Contains(sig, "md5") || strings.Contains(sig, "sha1") || strings.Contains(sig, "md2") {
+		return true
+	}
+	switch strings.ToLower(c.KeyType) {
+	case "rsa", "dsa":
+		return c.KeyBits > 0 && c.KeyBits < 2048
+	case "ec", "ecdsa":
+		return c.KeyBits > 0 && c.KeyBits < 224
+	}
+	return false
+}
+
+func (c *Cert) Flags() string {
+	var flags []string
+	if c.Expired() {
+		flags = append(flags, "expired")
+	}
+	if c.SelfSigned {
+		flags = append(flags, "selfsigned")
+	}
+	if c.Weak() {
+		flags = append(flags, "weak")
+	}
+	return strings.Join(flags, ",")
+}
+
+// subjectCommonName finds the CN of a subject in the nmap form
+// (commonName=a/organizationName=b) or the x509 one (CN=a,O=b).
+func subjectCommonName(subject string) string {
+	for _, part := range strings.FieldsFunc(subject, func(r rune) bool { return r == '/' || r == ',' }) {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && (k == "commonName" || k == "CN") {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+func (c *Cert) Names() []string {
+	names := strings.Split(c.Sans, ",")
+	if c.CommonName != "" {
+		names = append(names, c.CommonName)
+	} else {
+		names = append(names, subjectCommonName(c.Subject))
+	}
+	var res []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func certFromX509(x *x509.Certificate) Cert {
+	sum := sha256.Sum256(x.Raw)
+	c := Cert{
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Subject:     x.Subject.String(),
+		CommonName:  x.Subject.CommonName,
+		Issuer:      x.Issuer.String(),
+		NotBefore:   x.NotBefore,
+		NotAfter:    x.NotAfter,
+		SigAlg:      x.SignatureAlgorithm.String(),
+	}
+	sans := append([]string{}, x.DNSNames...)
+	for _, ip := range x.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, x.EmailAddresses...)
+	c.Sans = strings.Join(sans, ",")
+
+	switch key := x.PublicKey.(type) {
+	case *rsa.PublicKey:
+		c.KeyType, c.KeyBits = "rsa", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		c.KeyType, c.KeyBits = "ec", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		c.KeyType, c.KeyBits = "ed25519", 256
+	}
+	c.SelfSigned = x.Subject.String() == x.Issuer.String() && x.CheckSignatureFrom(x) == nil
+	return c
+}
+
+// parseCerts reads every certificate of a PEM bundle or a single DER blob.
+func parseCerts(content []byte) ([]Cert, error) {
+	var certs []Cert
+	rest := content
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		x, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, certFromX509(x))
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+	x, err := x509.ParseCertificate(content)
+	if err != nil {
+		return nil, fmt.Errorf("no PEM or DER certificate found")
+	}
+	return []Cert{certFromX509(x)}, nil
+}
+
+func parseNseTime(s string) time.Time {
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04:05-07:00", time.RFC3339} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func nseName(v any) string {
+	m, ok := v.(map[string]any)
+	if !ok {
+		s, _ := v.(string)
+		return s
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, m[k]))
+	}
+	return strings.Join(parts, "/")
+}
+
+// certFromSslCert builds the inventory entry of an ssl-cert script, from the
+// pem element when present, then from the structured or the text output.
+func certFromSslCert(script *Script) (Cert, bool) {
+	data, ok := script.Structured().(map[string]any)
+	if ok {
+		if p, ok := data["pem"].(string); ok {
+			if certs, err := parseCerts([]byte(p)); err == nil {
+				return certs[0], true
+			}
+		}
+		c := Cert{
+			Subject: nseName(data["subject"]),
+			Issuer:  nseName(data["issuer"]),
+			Sans:    strings.Join(sslCertSans(script), ","),
+		}
+		if subject, ok := data["subject"].(map[string]any); ok {
+			c.CommonName, _ = subject["commonName"].(string)
+		}
+		c.SigAlg, _ = data["sig_algo"].(string)
+		if pk, ok := data["pubkey"].(map[string]any); ok {
+			c.KeyType, _ = pk["type"].(string)
+			c.KeyBits, _ = strconv.Atoi(fmt.Sprint(pk["bits"]))
+		}
+		if validity, ok := data["validity"].(map[string]any); ok {
+			c.NotBefore = parseNseTime(fmt.Sprint(validity["notBefore"]))
+			c.NotAfter = parseNseTime(fmt.Sprint(validity["notAfter"]))
+		}
+		c.SelfSigned = c.Subject == c.Issuer
+		return c, true
+	}
+
+	if script.Output == "" {
+		return Cert{}, false
+	}
+	c := Cert{}
+	for _, line := range strings.Split(script.Output, "\n") {
+		k, v, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch k {
+		case "Subject":
+			c.Subject = v
+		case "Issuer":
+			c.Issuer = v
+		case "Subject Alternative Name":
+			var sans []string
+			for _, san := range strings.Split(v, ",") {
+				_, name, _ := strings.Cut(strings.TrimSpace(san), ":")
+				sans = append(sans, name)
+			}
+			c.Sans = strings.Join(sans, ",")
+		case "Public Key type":
+			c.KeyType = v
+		case "Public Key bits":
+			c.KeyBits, _ = strconv.Atoi(v)
+		case "Signature Algorithm":
+			c.SigAlg = v
+		case "Not valid before":
+			c.NotBefore = parseNseTime(v)
+		case "Not valid after":
+			c.NotAfter = parseNseTime(v)
+		}
+	}
+	c.CommonName = subjectCommonName(c.Subject)
+	c.SelfSigned = c.Subject != "" && c.Subject == c.Issuer
+	return c, c.Subject != ""
+}
+
+// syncNmapCerts rebuilds the nmap part of the inventory from stored ssl-cert scripts.
+func syncNmapCerts(db *gorm.DB) (int, error) {
+	refs, err := findScripts(db, "ssl-cert")
+	if err != nil {
+		return 0, err
+	}
+	var certs []Cert
+	for _, ref := range refs {
+		c, ok := certFromSslCert(&ref.Script)
+		if !ok {
+			continue
+		}
+		c.IP, c.Port, c.Source = ref.IP, ref.Port, "nmap"
+		certs = append(certs, c)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("source = ?", "nmap").Delete(&Cert{}).Error; err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(certs, 500).Error
+	})
+	return len(certs), err
+}
+
+func CertRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/certs/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] CERT UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		certs, err := parseCerts(content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ip := r.URL.Query().Get("ip")
+		scope, err := LoadScope(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if status := scope.Status(ip, ""); ip != "" && scopeOutside(status) {
+			if r.URL.Query().Get("scope") == "reject" {
+				http.Error(w, fmt.Sprintf("%s out of scope (%s)", ip, status), http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(fmt.Sprintf("WARNING %s out of scope (%s) \n", ip, status)))
+		}
+		port, _ := strconv.Atoi(r.URL.Query().Get("port"))
+		for i := range certs {
+			certs[i].IP = ip
+			certs[i].Port = uint(port)
+			certs[i].Source = "upload"
+		}
+		if err := db.Create(&certs).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, c := range certs {
+			w.Write([]byte(fmt.Sprintf("adding %s \n", c.Subject)))
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/certs/rebuild", func(w http.ResponseWriter, r *http.Request) {
+		n, err := syncNmapCerts(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("rebuilt %d certs\nOK\n", n)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		var certs []Cert
+		if err := db.Order("ip").Order("port").Find(&certs).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var filters []string
+		if f := r.URL.Query().Get("filter"); f != "" {
+			filters = strings.Split(f, ",")
+		}
+		res := ""
+		for _, c := range certs {
+			keep := true
+			for _, f := range filters {
+				switch f {
+				case "expired":
+					keep = keep && c.Expired()
+				case "selfsigned":
+					keep = keep && c.SelfSigned
+				case "weak":
+					keep = keep && c.Weak()
+				}
+			}
+			if !keep {
+				continue
+			}
+			res = res + fmt.Sprintf("%s:%d\t%s\t%s\tissuer=%s\t%s..%s\t%s/%d\t%s\t%s\n",
+				c.IP, c.Port, c.Subject, c.Sans, c.Issuer,
+				c.NotBefore.Format("2006-01-02"), c.NotAfter.Format("2006-01-02"),
+				c.KeyType, c.KeyBits, c.SigAlg, c.Flags())
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/certs/hostnames", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		var certs []Cert
+		if err := db.Find(&certs).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		seen := make(map[string][]string)
+		for _, c := range certs {
+			addr := net.JoinHostPort(c.IP, strconv.Itoa(int(c.Port)))
+			for _, name := range c.Names() {
+				if n := len(seen[name]); n == 0 || seen[name][n-1] != addr {
+					seen[name] = append(seen[name], addr)
+				}
+			}
+		}
+		names := make([]string, 0, len(seen))
+		for name := range seen {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res := ""
+		for _, name := range names {
+			res = res + fmt.Sprintf("%s\t%s\n", name, strings.Join(seen[name], " "))
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type Cve struct {
+	gorm.Model
+	Name    string `gorm:"size:64;uniqueIndex"`
+	Cvss    float64
+	Summary string
+	Matches []CveMatch `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type CveMatch struct {
+	gorm.Model
+	CveID     uint   `gorm:"index"`
+	Vendor    string `gorm:"size:255;index"`
+	Product   string `gorm:"size:255;index"`
+	Version   string
+	StartIncl string
+	StartExcl string
+	EndIncl   string
+	EndExcl   string
+}
+
+type CpeProduct struct {
+	gorm.Model
+	Vendor  string `gorm:"size:255;index"`
+	Product string `gorm:"size:255;index"`
+	Title   string
+}
+
+type cveTarget struct {
+	Vendor  string
+	Product string
+	Version string
+}
+
+type nvdCpeMatch struct {
+	Vulnerable bool   `json:"vulnerable"`
+	Cpe23Uri   string `json:"cpe23Uri"`
+	Criteria   string `json:"criteria"`
+	StartIncl  string `json:"versionStartIncluding"`
+	StartExcl  string `json:"versionStartExcluding"`
+	EndIncl    string `json:"versionEndIncluding"`
+	EndExcl    string `json:"versionEndExcluding"`
+}
+
+type nvdNode struct {
+	Children  []nvdNode     `json:"children"`
+	CpeMatch  []nvdCpeMatch `json:"cpe_match"`
+	CpeMatch2 []nvdCpeMatch `json:"cpeMatch"`
+}
+
+type nvdText struct {
+	Lang  string `json:"lang"`
+	Value string `json:"value"`
+}
+
+type nvdScore struct {
+	CvssData struct {
+		BaseScore float64 `json:"baseScore"`
+	} `json:"cvssData"`
+}
+
+// nvdItem holds one entry of either a 1.1 feed (CVE_Items) or a 2.0 API
+// dump (vulnerabilities), both shapes are decoded in the same struct.
+type nvdItem struct {
+	Cve struct {
+		ID   string `json:"id"`
+		Meta struct {
+			ID string `json:"ID"`
+		} `json:"CVE_data_meta"`
+		Description struct {
+			Data []nvdText `json:"description_data"`
+		} `json:"description"`
+		Descriptions []nvdText `json:"descriptions"`
+		Metrics      struct {
+			V31 []nvdScore `json:"cvssMetricV31"`
+			V30 []nvdScore `json:"cvssMetricV30"`
+			V2  []nvdScore `json:"cvssMetricV2"`
+		} `json:"metrics"`
+		Configurations []struct {
+			Nodes []nvdNode `json:"nodes"`
+		} `json:"configurations"`
+	} `json:"cve"`
+	Configurations struct {
+		Nodes []nvdNode `json:"nodes"`
+	} `json:"configurations"`
+	Impact struct {
+		V3 struct {
+			Cvss struct {
+				BaseScore float64 `json:"baseScore"`
+			} `json:"cvssV3"`
+		} `json:"baseMetricV3"`
+		V2 struct {
+			Cvss struct {
+				BaseScore float64 `json:"baseScore"`
+			} `json:"cvssV2"`
+		} `json:"baseMetricV2"`
+	} `json:"impact"`
+}
+
+func (item *nvdItem) toCve() Cve {
+	c := Cve{Name: item.Cve.ID}
+	if c.Name == "" {
+		c.Name = item.Cve.Meta.ID
+	}
+
+	texts := append(item.Cve.Descriptions, item.Cve.Description.Data...)
+	for _, t := range texts {
+		if t.Lang == "en" {
+			c.Summary = t.Value
+			break
+		}
+	}
+
+	m := item.Cve.Metrics
+	switch {
+	case len(m.V31) > 0:
+		c.Cvss = m.V31[0].CvssData.BaseScore
+	case len(m.V30) > 0:
+		c.Cvss = m.V30[0].CvssData.BaseScore
+	case item.Impact.V3.Cvss.BaseScore > 0:
+		c.Cvss = item.Impact.V3.Cvss.BaseScore
+	case len(m.V2) > 0:
+		c.Cvss = m.V2[0].CvssData.BaseScore
+	default:
+		c.Cvss = item.Impact.V2.Cvss.BaseScore
+	}
+
+	nodes := item.Configurations.Nodes
+	for _, conf := range item.Cve.Configurations {
+		nodes = append(nodes, conf.Nodes...)
+	}
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = append(nodes[1:], node.Children...)
+		for _, cm := range append(node.CpeMatch, node.CpeMatch2...) {
+			if !cm.Vulnerable {
+				continue
+			}
+			uri := cm.Cpe23Uri
+			if uri == "" {
+				uri = cm.Criteria
+			}
+			_, vendor, product, version := splitCpe(uri)
+			if product == "" {
+				continue
+			}
+			c.Matches = append(c.Matches, CveMatch{
+				Vendor:    vendor,
+				Product:   product,
+				Version:   version,
+				StartIncl: cm.StartIncl,
+				StartExcl: cm.StartExcl,
+				EndIncl:   cm.EndIncl,
+				EndExcl:   cm.EndExcl,
+			})
+		}
+	}
+	return c
+}
+
+// splitCpe accepts both the 2.2 uri form used by nmap (cpe:/a:vendor:product:version)
+// and the 2.3 formatted string used by NVD (cpe:2.3:a:vendor:product:version:...).
+func splitCpe(cpe string) (part, vendor, product, version string) {
+	var fields []string
+	switch {
+	case strings.HasPrefix(cpe, "cpe:2.3:"):
+		fields = strings.Split(cpe[len("cpe:2.3:"):], ":")
+	case strings.HasPrefix(cpe, "cpe:/"):
+		fields = strings.Split(cpe[len("cpe:/"):], ":")
+	default:
+		return
+	}
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	return fields[0], strings.ToLower(fields[1]), strings.ToLower(fields[2]), fields[3]
+}
+
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func versionTokens(v string) []string {
+	var tokens []string
+	cur := ""
+	for _, r := range strings.ToLower(v) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if cur != "" {
+				tokens = append(tokens, cur)
+			}
+			cur = ""
+			continue
+		}
+		if cur != "" && unicode.IsDigit(r) != unicode.IsDigit(rune(cur[len(cur)-1])) {
+			tokens = append(tokens, cur)
+			cur = ""
+		}
+		cur += string(r)
+	}
+	if cur != "" {
+		tokens = append(tokens, cur)
+	}
+	return tokens
+}
+
+func versionCmp(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(ta) || i < len(tb); i++ {
+		if i >= len(ta) {
+			return -1
+		}
+		if i >= len(tb) {
+			return 1
+		}
+		na, erra := strconv.Atoi(ta[i])
+		nb, errb := strconv.Atoi(tb[i])
+		if erra == nil && errb == nil {
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(ta[i], tb[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (m *CveMatch) matchVersion(version string) bool {
+	if version == "" {
+		return false
+	}
+	if m.Version != "" && m.Version != "*" && m.Version != "-" {
+		return versionCmp(m.Version, version) == 0
+	}
+	if m.StartIncl == "" && m.StartExcl == "" && m.EndIncl == "" && m.EndExcl == "" {
+		return false
+	}
+	if m.StartIncl != "" && versionCmp(version, m.StartIncl) < 0 {
+		return false
+	}
+	if m.StartExcl != "" && versionCmp(version, m.StartExcl) <= 0 {
+		return false
+	}
+	if m.EndIncl != "" && versionCmp(version, m.EndIncl) > 0 {
+		return false
+	}
+	if m.EndExcl != "" && versionCmp(version, m.EndExcl) >= 0 {
+		return false
+	}
+	return true
+}
+
+func cvssSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "CRITICAL"
+	case score >= 7:
+		return "HIGH"
+	case score >= 4:
+		return "MEDIUM"
+	case score > 0:
+		return "LOW"
+	}
+	return "NONE"
+}
+
+func portCveTargets(db *gorm.DB, port *Port) []cveTarget {
+	var targets []cveTarget
+	version := ""
+	if fields := strings.Fields(port.Version); len(fields) > 0 {
+		version = fields[0]
+	}
+
+	for _, cpe := range strings.Fields(port.CPE) {
+		part, vendor, product, cpeVersion := splitCpe(cpe)
+		if part != "a" || product == "" {
+			continue
+		}
+		if cpeVersion == "" {
+			cpeVersion = version
+		}
+		targets = append(targets, cveTarget{Vendor: vendor, Product: product, Version: cpeVersion})
+	}
+
+	if len(targets) == 0 && port.Product != "" {
+		name := strings.Fields(strings.ToLower(port.Product))
+		var cp CpeProduct
+		err := db.Where("product = ?", strings.Join(name, "_")).Order("vendor, id").Take(&cp).Error
+		if err != nil && len(name) > 1 {
+			err = db.Where("vendor = ? AND product = ?", name[0], strings.Join(name[1:], "_")).Order("id").Take(&cp).Error
+		}
+		if err == nil {
+			targets = append(targets, cveTarget{Vendor: cp.Vendor, Product: cp.Product, Version: version})
+		}
+	}
+	return targets
+}
+
+func MatchCves(db *gorm.DB, port *Port) ([]Cve, error) {
+	ids := make(map[uint]bool)
+	for _, target := range portCveTargets(db, port) {
+		if target.Version == "" {
+			continue
+		}
+		var matches []CveMatch
+		q := db.Where("product = ?", target.Product)
+		if target.Vendor != "" {
+			q = q.Where("vendor = ?", target.Vendor)
+		}
+		if err := q.Find(&matches).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if m.matchVersion(target.Version) {
+				ids[m.CveID] = true
+			}
+		}
+	}
+
+	var cves []Cve
+	if len(ids) == 0 {
+		return cves, nil
+	}
+	var keys []uint
+	for id := range ids {
+		keys = append(keys, id)
+	}
+	if err := db.Where("id IN ?", keys).Order("cvss desc").Find(&cves).Error; err != nil {
+		return nil, err
+	}
+	return cves, nil
+}
+
+func decodeNvd(r io.Reader, fn func(*nvdItem) error) error {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("feed is not a json object")
+	}
+	for {
+		if !dec.More() {
+			return fmt.Errorf("no CVE_Items or vulnerabilities in feed")
+		}
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key := t.(string); key == "CVE_Items" || key == "vulnerabilities" {
+			break
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		var item nvdItem
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		if err := fn(&item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveCves(db *gorm.DB, cves []Cve) error {
+	// a feed can list the same cve twice in a batch, the last entry wins
+	index := make(map[string]int)
+	var uniq []Cve
+	for _, c := range cves {
+		if i, ok := index[c.Name]; ok {
+			uniq[i] = c
+			continue
+		}
+		index[c.Name] = len(uniq)
+		uniq = append(uniq, c)
+	}
+	cves = uniq
+	return db.Transaction(func(tx *gorm.DB) error {
+		var names []string
+		for _, c := range cves {
+			names = append(names, c.Name)
+		}
+		var old []uint
+		if err := tx.Model(&Cve{}).Where("name IN ?", names).Pluck("id", &old).Error; err != nil {
+			return err
+		}
+		if len(old) > 0 {
+			if err := tx.Unscoped().Where("cve_id IN ?", old).Delete(&CveMatch{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("id IN ?", old).Delete(&Cve{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&cves).Error
+	})
+}
+
+func importNvd(w io.Writer, db *gorm.DB, r io.Reader) error {
+	r, err := maybeGunzip(r)
+	if err != nil {
+		return err
+	}
+	var batch []Cve
+	total := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := saveCves(db, batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		w.Write([]byte(fmt.Sprintf("imported %d cves \n", total)))
+		batch = batch[:0]
+		return nil
+	}
+	err = decodeNvd(r, func(item *nvdItem) error {
+		c := item.toCve()
+		if c.Name == "" || len(c.Matches) == 0 {
+			return nil
+		}
+		batch = append(batch, c)
+		if len(batch) >= 500 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func importCpeDictionary(w io.Writer, db *gorm.DB, r io.Reader) error {
+	r, err := maybeGunzip(r)
+	if err != nil {
+		return err
+	}
+
+	type cpeItem struct {
+		Name   string `xml:"name,attr"`
+		Titles []struct {
+			Lang  string `xml:"lang,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"title"`
+		Cpe23 struct {
+			Name string `xml:"name,attr"`
+		} `xml:"cpe23-item"`
+	}
+
+	seen := make(map[string]bool)
+	var batch []CpeProduct
+	dec := xml.NewDecoder(r)
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "cpe-item" {
+			continue
+		}
+		var item cpeItem
+		if err := dec.DecodeElement(&item, &se); err != nil {
+			return err
+		}
+		name := item.Cpe23.Name
+		if name == "" {
+			name = item.Name
+		}
+		_, vendor, product, _ := splitCpe(name)
+		if product == "" || seen[vendor+":"+product] {
+			continue
+		}
+		seen[vendor+":"+product] = true
+		title := ""
+		if len(item.Titles) > 0 {
+			title = strings.ToLower(item.Titles[0].Value)
+		}
+		batch = append(batch, CpeProduct{Vendor: vendor, Product: product, Title: title})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("1 = 1").Delete(&CpeProduct{}).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(batch, 500).Error
+	})
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(fmt.Sprintf("imported %d cpe products \n", len(batch))))
+	return nil
+}
+
+// formatCve gives one line per cve, the summary is cut on runes to keep
+// the text valid utf-8.
+func formatCve(c Cve) string {
+	summary := []rune(c.Summary)
+	if len(summary) > 120 {
+		summary = append(summary[:120], []rune("...")...)
+	}
+	return fmt.Sprintf("%s %.1f %s %s", c.Name, c.Cvss, cvssSeverity(c.Cvss), string(summary))
+}
+
+func CveRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/cve/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] CVE UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		if err := importNvd(w, db, r.Body); err != nil {
+			w.Write([]byte(fmt.Sprintf("unable to import feed : %v\nNOK\n", err)))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/cve/cpe/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] CPE UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		if err := importCpeDictionary(w, db, r.Body); err != nil {
+			w.Write([]byte(fmt.Sprintf("unable to import dictionary : %v\nNOK\n", err)))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/show/{ip}/cve", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		ip := mux.Vars(r)["ip"]
+		var host Host
+		if err := db.Preload("Ports").Take(&host, "IP = ?", ip).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		sort.Slice(host.Ports, func(i, j int) bool { return host.Ports[i].Port < host.Ports[j].Port })
+		res := ""
+		for _, port := range host.Ports {
+			cves, err := MatchCves(db, &port)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(cves) == 0 {
+				continue
+			}
+			res = res + fmt.Sprintf("%d/%s %s %s\n", port.Port, port.Protocol, port.Product, port.Version)
+			for _, c := range cves {
+				res = res + fmt.Sprintf("\t%s\n", formatCve(c))
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
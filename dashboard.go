@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type countRow struct {
+	Label string
+	Link  string
+	Count int
+}
+
+type Dashboard struct {
+	Hosts       countRow
+	OpenPorts   countRow
+	Services    countRow
+	Exploits    countRow
+	Cards       []countRow
+	TopPorts    []countRow
+	TopServices []countRow
+	TopHosts    []countRow
+	Severities  []countRow
+	LastScan    *Scan
+	Newest      []countRow
+}
+
+type Finding struct {
+	IP       string
+	Port     uint
+	Protocol string
+	Product  string
+	Version  string
+	Cve      Cve
+}
+
+func hostLink(ip string) string {
+	return "/nmap/host/" + url.PathEscape(ip)
+}
+
+// hostPort is a port along with the ip of its host.
+type hostPort struct {
+	IP   string
+	Port Port `gorm:"embedded"`
+}
+
+// hostPorts returns the ports matching the condition along with the ip of
+// their host ordered by ip and port, preloading the ports of every host
+// would exceed the sqlite variable limit on large scans.
+func hostPorts(db *gorm.DB, query string, args ...any) ([]hostPort, error) {
+	var rows []hostPort
+	err := db.Table("ports").Select("hosts.ip, ports.*").
+		Joins("JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL").
+		Where("ports.deleted_at IS NULL").Where(query, args...).
+		Order("hosts.ip, ports.port").Scan(&rows).Error
+	return rows, err
+}
+
+// AllFindings returns the candidate cves of every open port, highest cvss first.
+func AllFindings(db *gorm.DB) ([]Finding, error) {
+	rows, err := hostPorts(db, "ports.state = ? AND ports.product <> ''", "open")
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, row := range rows {
+		port := row.Port
+		cves, err := MatchCves(db, &port)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cves {
+			findings = append(findings, Finding{IP: row.IP, Port: port.Port, Protocol: port.Protocol, Product: port.Product, Version: port.Version, Cve: c})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Cve.Cvss > findings[j].Cve.Cvss })
+	return findings, nil
+}
+
+// matchCache keeps the cve findings and the number of ports with a known
+// exploit, matching every port is only redone once a table it reads has
+// changed.
+var matchCache struct {
+	sync.Mutex
+	key      string
+	findings []Finding
+	exploits int
+}
+
+// matchTablesKey sums up the tables read by the cve and exploit matching,
+// an insert, update or delete in any of them changes it.
+func matchTablesKey(db *gorm.DB) (string, error) {
+	key := ""
+	for _, table := range []string{"hosts", "ports", "cves", "cve_matches", "cpe_products", "exploits"} {
+		var n, last int64
+		var updated, deleted sql.NullString
+		err := db.Raw(fmt.Sprintf("SELECT COUNT(*), COALESCE(MAX(id), 0), MAX(updated_at), MAX(deleted_at) FROM %s", table)).
+			Row().Scan(&n, &last, &updated, &deleted)
+		if err != nil {
+			return "", err
+		}
+		key = key + fmt.Sprintf("%s:%d:%d:%s:%s ", table, n, last, updated.String, deleted.String)
+	}
+	return key, nil
+}
+
+func exploitPorts(db *gorm.DB) (int, error) {
+	exploits := 0
+	matcher := newExploitMatcher(db)
+	var withProduct []Port
+	if err := db.Where("state = ? AND product <> ''", "open").Find(&withProduct).Error; err != nil {
+		return 0, err
+	}
+	for _, port := range withProduct {
+		res, err := matcher.Match(&port)
+		if err != nil {
+			return 0, err
+		}
+		if len(res) > 0 {
+			exploits++
+		}
+	}
+	return exploits, nil
+}
+
+// cachedMatches returns AllFindings and the number of ports with a known
+// exploit from matchCache while the data behind them is unchanged.
+func cachedMatches(db *gorm.DB) ([]Finding, int, error) {
+	key, err := matchTablesKey(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	matchCache.Lock()
+	defer matchCache.Unlock()
+	if matchCache.key == key {
+		return matchCache.findings, matchCache.exploits, nil
+	}
+	findings, err := AllFindings(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	exploits, err := exploitPorts(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	matchCache.key, matchCache.findings, matchCache.exploits = key, findings, exploits
+	return findings, exploits, nil
+}
+
+func BuildDashboard(db *gorm.DB) (*Dashboard, error) {
+	d := &Dashboard{
+		Hosts:     countRow{Label: "hosts", Link: "/nmap/ips"},
+		OpenPorts: countRow{Label: "open ports", Link: "/nmap/query?state=open"},
+		Services:  countRow{Label: "services", Link: "/nmap/query?state=open"},
+		Exploits:  countRow{Label: "exploits", Link: "/nmap/exploits"},
+	}
+
+	var n int64
+	if err := db.Model(&Host{}).Count(&n).Error; err != nil {
+		return nil, err
+	}
+	d.Hosts.Count = int(n)
+	if err := db.Model(&Port{}).Where("state = ?", "open").Count(&n).Error; err != nil {
+		return nil, err
+	}
+	d.OpenPorts.Count = int(n)
+	if err := db.Model(&Port{}).Where("state = ? AND service <> ''", "open").Distinct("service").Count(&n).Error; err != nil {
+		return nil, err
+	}
+	d.Services.Count = int(n)
+
+	var ports []struct {
+		Port     uint
+		Protocol string
+		Count    int
+	}
+	err := db.Model(&Port{}).Select("port, protocol, COUNT(*) AS count").Where("state = ?", "open").
+		Group("port, protocol").Order("count desc").Limit(20).Scan(&ports).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ports {
+		d.TopPorts = append(d.TopPorts, countRow{
+			Label: fmt.Sprintf("%d/%s", p.Port, p.Protocol),
+			Link:  fmt.Sprintf("/nmap/query?state=open&ports=%d&proto=%s", p.Port, url.QueryEscape(p.Protocol)),
+			Count: p.Count,
+		})
+	}
+
+	var services []struct {
+		Service string
+		Count   int
+	}
+	err = db.Model(&Port{}).Select("service, COUNT(*) AS count").Where("state = ? AND service <> ''", "open").
+		Group("service").Order("count desc").Limit(20).Scan(&services).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		d.TopServices = append(d.TopServices, countRow{
+			Label: s.Service,
+			Link:  "/nmap/query?state=open&service=" + url.QueryEscape(s.Service),
+			Count: s.Count,
+		})
+	}
+
+	hosts, err := subnetHosts(db)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Open > hosts[j].Open })
+	for i, h := range hosts {
+		if i == 20 {
+			break
+		}
+		d.TopHosts = append(d.TopHosts, countRow{Label: h.IP, Link: hostLink(h.IP), Count: h.Open})
+	}
+
+	var scan Scan
+	err = db.Order("id desc").Take(&scan).Error
+	if err == nil {
+		d.LastScan = &scan
+		// hosts first seen by the last scan, the ones seen before are not new
+		first := db.Model(&ScanHost{}).Select("host_id").Group("host_id").Having("MIN(scan_id) = ?", scan.ID)
+		var newest []Host
+		if err := db.Select("ip").Where("id IN (?)", first).Order("created_at desc, id desc").Limit(20).Find(&newest).Error; err != nil {
+			return nil, err
+		}
+		open := make(map[string]int)
+		for _, h := range hosts {
+			open[h.IP] = h.Open
+		}
+		for _, h := range newest {
+			d.Newest = append(d.Newest, countRow{Label: h.IP, Link: hostLink(h.IP), Count: open[h.IP]})
+		}
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	findings, exploits, err := cachedMatches(db)
+	if err != nil {
+		return nil, err
+	}
+	bySeverity := make(map[string]int)
+	for _, f := range findings {
+		bySeverity[cvssSeverity(f.Cve.Cvss)]++
+	}
+	for _, severity := range []string{"CRITICAL", "HIGH", "MEDIUM", "LOW"} {
+		d.Severities = append(d.Severities, countRow{
+			Label: strings.ToLower(severity),
+			Link:  "/nmap/findings?severity=" + severity,
+			Count: bySeverity[severity],
+		})
+	}
+
+	d.Exploits.Count = exploits
+	d.Cards = []countRow{d.Hosts, d.OpenPorts, d.Services, d.Exploits}
+
+	return d, nil
+}
+
+func DashboardRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/findings", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		severity := strings.ToUpper(r.URL.Query().Get("severity"))
+		findings, _, err := cachedMatches(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, f := range findings {
+			if severity != "" && cvssSeverity(f.Cve.Cvss) != severity {
+				continue
+			}
+			res = res + fmt.Sprintf("%s:%d/%s\t%s %s\t%s %.1f %s\n", f.IP, f.Port, f.Protocol, f.Product, f.Version, f.Cve.Name, f.Cve.Cvss, cvssSeverity(f.Cve.Cvss))
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		t, err := template.ParseFS(tpls, "templates/dashboard.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d, err := BuildDashboard(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := t.ExecuteTemplate(w, "page", TemplateRender{Title: "dashboard", Data: d}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+}
+
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Printf("[%s] DASHBOARD VIEW [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+
+	db := database
+
+	t, err := template.ParseFS(tpls, "templates/base.html", "templates/dashboard.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d, err := BuildDashboard(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tr := TemplateRender{Title: "dashboard", Data: d, Sidebar: GenerateJsonNav()}
+
+	if err := t.ExecuteTemplate(w, "base", tr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	dbBusyTimeout = 30000 // ms
+	dbMaxConns    = 8
+)
+
+// database is opened once by SetupGorm and shared by every handler and job.
+var database *gorm.DB
+
+// sqlitePath returns the file of a sqlite dsn, which is a plain path or a
+// sqlite:// url.
+func sqlitePath(dsn string) (string, bool) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") || strings.HasPrefix(dsn, "mysql://") {
+		return "", false
+	}
+	return strings.TrimPrefix(dsn, "sqlite://"), true
+}
+
+// dialector picks the driver from the dsn scheme. A sqlite file is opened
+// in WAL mode so reads do not wait for an import, writers wait for each
+// other up to the busy timeout and take the write lock when their
+// transaction starts instead of failing on upgrade. Foreign keys are off by
+// default in sqlite, they are turned on so the ON DELETE CASCADE of the
+// nmap relations applies as it does on postgres and mysql.
+func dialector(dsn string) gorm.Dialector {
+	if path, ok := sqlitePath(dsn); ok {
+		return sqlite.Open(fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_pragma=synchronous(NORMAL)&_pragma=foreign_keys(1)&_txlock=immediate",
+			path, dbBusyTimeout))
+	}
+	if strings.HasPrefix(dsn, "mysql://") {
+		// go-sql-driver format, user:pass@tcp(host:3306)/wikix
+		dsn = strings.TrimPrefix(dsn, "mysql://")
+		if !strings.Contains(dsn, "parseTime=") {
+			sep := "?"
+			if strings.Contains(dsn, "?") {
+				sep = "&"
+			}
+			dsn = dsn + sep + "parseTime=true"
+		}
+		return mysql.Open(dsn)
+	}
+	return postgres.Open(dsn)
+}
+
+func openDatabase(dsn string) (*gorm.DB, error) {
+	db, err := gorm.Open(dialector(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect database %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(dbMaxConns)
+	sqlDB.SetMaxIdleConns(dbMaxConns)
+	return db, nil
+}
+
+// dbError answers 404 when the record is missing and 500 on any other
+// database failure.
+func dbError(w http.ResponseWriter, err error, what string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, what+" not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// DnsRecord is a name seen in dns data, Type and Value are empty for names
+// listed without any answer. A and AAAA records point to the host of their
+// address once it is scanned.
+type DnsRecord struct {
+	gorm.Model
+	Name   string `gorm:"size:255;index"`
+	Type   string `gorm:"size:16"`
+	Value  string
+	HostID *uint `gorm:"index"`
+	Source string
+}
+
+var dnsKeptTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true, "MX": true, "TXT": true}
+
+// dnsTypes are recognized in zone and dig lines, the ones not kept are
+// skipped.
+var dnsTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true, "MX": true, "TXT": true,
+	"NS": true, "SOA": true, "PTR": true, "SRV": true, "CAA": true, "DNAME": true, "HINFO": true, "SPF": true,
+	"DS": true, "DNSKEY": true, "RRSIG": true, "NSEC": true, "NSEC3": true, "TLSA": true, "SSHFP": true}
+
+func dnsName(name, origin string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin != "" {
+		return name + "." + origin
+	}
+	return name
+}
+
+func validDnsName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/:@\" \t")
+}
+
+func addrRecord(name, value string) (DnsRecord, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil {
+		return DnsRecord{}, false
+	}
+	if addr.Is4() || addr.Is4In6() {
+		return DnsRecord{Name: name, Type: "A", Value: addr.Unmap().String()}, true
+	}
+	return DnsRecord{Name: name, Type: "AAAA", Value: addr.String()}, true
+}
+
+// dnsParser reads line lists, json lines from subfinder, amass or dnsx,
+// zone files and dig answers, the format is guessed line by line.
+type dnsParser struct {
+	origin  string
+	owner   string
+	pending string
+}
+
+// stripDnsComment cuts a zone comment, ; inside a quoted string is kept.
+func stripDnsComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func (p *dnsParser) parseLine(line string) []DnsRecord {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return p.parseJson(line)
+	}
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return nil
+	}
+	line = stripDnsComment(line)
+	if p.pending != "" || strings.Count(line, "(") > strings.Count(line, ")") {
+		p.pending = p.pending + " " + line
+		if strings.Count(p.pending, "(") > strings.Count(p.pending, ")") {
+			return nil
+		}
+		line, p.pending = strings.NewReplacer("(", " ", ")", " ").Replace(p.pending), ""
+	}
+	continued := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+	fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(line))
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "$ORIGIN":
+		if len(fields) > 1 {
+			p.origin = dnsName(fields[1], "")
+		}
+		return nil
+	case "$TTL", "$INCLUDE", "$GENERATE":
+		return nil
+	}
+
+	if continued && p.owner != "" {
+		fields = append([]string{p.owner}, fields...)
+	}
+	for i := 1; i < len(fields) && i <= 3; i++ {
+		kind := strings.ToUpper(fields[i])
+		if !dnsTypes[kind] {
+			continue
+		}
+		p.owner = fields[0]
+		if !dnsKeptTypes[kind] || i+1 >= len(fields) {
+			return nil
+		}
+		name, rdata := dnsName(fields[0], p.origin), fields[i+1:]
+		switch kind {
+		case "A", "AAAA":
+			if rec, ok := addrRecord(name, rdata[0]); ok {
+				return []DnsRecord{rec}
+			}
+			return nil
+		case "CNAME":
+			return []DnsRecord{{Name: name, Type: kind, Value: dnsName(rdata[0], p.origin)}}
+		case "MX":
+			return []DnsRecord{{Name: name, Type: kind, Value: dnsName(rdata[len(rdata)-1], p.origin)}}
+		case "TXT":
+			txt := strings.ReplaceAll(strings.Join(rdata, " "), "\" \"", "")
+			return []DnsRecord{{Name: name, Type: kind, Value: strings.Trim(txt, "\"")}}
+		}
+	}
+
+	// plain list, a name optionally followed by its addresses
+	fields = strings.FieldsFunc(strings.Join(fields, " "), func(c rune) bool { return c == ',' || c == ' ' })
+	name := dnsName(fields[0], "")
+	if !validDnsName(name) {
+		return nil
+	}
+	var res []DnsRecord
+	for _, f := range fields[1:] {
+		if rec, ok := addrRecord(name, f); ok {
+			res = append(res, rec)
+		}
+	}
+	if len(res) == 0 {
+		res = append(res, DnsRecord{Name: name})
+	}
+	return res
+}
+
+func (p *dnsParser) parseJson(line string) []DnsRecord {
+	var obj map[string]any
+	if json.Unmarshal([]byte(line), &obj) != nil {
+		return nil
+	}
+	name, _ := obj["host"].(string)
+	if name == "" {
+		name, _ = obj["name"].(string)
+	}
+	name = dnsName(name, "")
+	if !validDnsName(name) {
+		return nil
+	}
+	strs := func(v any) []string {
+		var res []string
+		switch val := v.(type) {
+		case string:
+			res = append(res, val)
+		case []any:
+			for _, e := range val {
+				switch e := e.(type) {
+				case string:
+					res = append(res, e)
+				case map[string]any:
+					// amass addresses
+					if ip, ok := e["ip"].(string); ok {
+						res = append(res, ip)
+					}
+				}
+			}
+		}
+		return res
+	}
+
+	var res []DnsRecord
+	for _, key := range []string{"ip", "a", "aaaa", "addresses"} {
+		for _, v := range strs(obj[key]) {
+			if rec, ok := addrRecord(name, v); ok {
+				res = append(res, rec)
+			}
+		}
+	}
+	for _, v := range strs(obj["cname"]) {
+		res = append(res, DnsRecord{Name: name, Type: "CNAME", Value: dnsName(v, "")})
+	}
+	for _, v := range strs(obj["mx"]) {
+		fields := strings.Fields(v)
+		if len(fields) > 0 {
+			res = append(res, DnsRecord{Name: name, Type: "MX", Value: dnsName(fields[len(fields)-1], "")})
+		}
+	}
+	for _, v := range strs(obj["txt"]) {
+		res = append(res, DnsRecord{Name: name, Type: "TXT", Value: v})
+	}
+	if len(res) == 0 {
+		res = append(res, DnsRecord{Name: name})
+	}
+	return res
+}
+
+// scopeDnsRecords applies the scope to the records, the records without an
+// address follow the addresses of their name found in the same upload.
+func scopeDnsRecords(filter *scopeFilter, records []DnsRecord) []DnsRecord {
+	addrs := make(map[string]string)
+	for _, r := range records {
+		if r.Type != "A" && r.Type != "AAAA" {
+			continue
+		}
+		if ip, ok := addrs[r.Name]; !ok || scopeOutside(filter.scope.Status(ip, r.Name)) {
+			addrs[r.Name] = r.Value
+		}
+	}
+	var res []DnsRecord
+	for _, r := range records {
+		keep := false
+		if r.Type == "A" || r.Type == "AAAA" {
+			keep = filter.Keep(r.Name+" "+r.Value, r.Value, r.Name)
+		} else {
+			keep = filter.Keep(r.Name, addrs[r.Name], r.Name)
+		}
+		if keep {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func dnsKey(r *DnsRecord) string {
+	return r.Name + "\x00" + r.Type + "\x00" + r.Value
+}
+
+// addDnsRecords stores the records not already known and links them to the
+// scanned hosts, a name listed without answer is only kept until records
+// for it come in.
+func addDnsRecords(db *gorm.DB, records []DnsRecord) (int, error) {
+	var known []DnsRecord
+	if err := db.Select("name", "type", "value").Find(&known).Error; err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	bare := make(map[string]bool)
+	for i := range known {
+		seen[dnsKey(&known[i])] = true
+		if known[i].Type == "" {
+			bare[known[i].Name] = true
+		}
+	}
+	resolved := make(map[string]bool)
+	for i := range records {
+		if records[i].Type != "" {
+			resolved[records[i].Name] = true
+		}
+	}
+	for i := range known {
+		if known[i].Type != "" {
+			resolved[known[i].Name] = true
+		}
+	}
+
+	var added []DnsRecord
+	var replaced []string
+	for i := range records {
+		key := dnsKey(&records[i])
+		if seen[key] || (records[i].Type == "" && resolved[records[i].Name]) {
+			continue
+		}
+		seen[key] = true
+		added = append(added, records[i])
+		if records[i].Type != "" && bare[records[i].Name] {
+			bare[records[i].Name] = false
+			replaced = append(replaced, records[i].Name)
+		}
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for len(replaced) > 0 {
+			n := min(len(replaced), 500)
+			if err := tx.Unscoped().Where("type = '' AND name IN ?", replaced[:n]).Delete(&DnsRecord{}).Error; err != nil {
+				return err
+			}
+			replaced = replaced[n:]
+		}
+		if len(added) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(added, 500).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := linkDnsRecords(db); err != nil {
+		return 0, err
+	}
+	return len(added), linkAdComputers(db)
+}
+
+// linkDnsRecords points the address records to the host of their address,
+// it runs after every dns or nmap import and when hosts are added or
+// deleted by hand.
+func linkDnsRecords(db *gorm.DB) error {
+	return db.Model(&DnsRecord{}).Where("type IN ?", []string{"A", "AAAA"}).
+		Update("host_id", gorm.Expr("(SELECT hosts.id FROM hosts WHERE hosts.ip = dns_records.value AND hosts.deleted_at IS NULL LIMIT 1)")).Error
+}
+
+// nameResolver maps hostnames to addresses from the dns inventory, or the
+// scanned hostnames when no record is known, lookups are cached.
+type nameResolver struct {
+	db    *gorm.DB
+	cache map[string]string
+}
+
+func newNameResolver(db *gorm.DB) *nameResolver {
+	return &nameResolver{db: db, cache: make(map[string]string)}
+}
+
+func (n *nameResolver) IP(name string) (string, error) {
+	name = strings.ToLower(name)
+	if ip, ok := n.cache[name]; ok {
+		return ip, nil
+	}
+	var ips []string
+	err := n.db.Model(&DnsRecord{}).Where("name = ? AND type IN ?", name, []string{"A", "AAAA"}).
+		Order("host_id IS NULL, id").Limit(1).Pluck("value", &ips).Error
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		if err := n.db.Model(&Host{}).Where("hostname = ?", name).Limit(1).Pluck("ip", &ips).Error; err != nil {
+			return "", err
+		}
+	}
+	ip := ""
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	n.cache[name] = ip
+	return ip, nil
+}
+
+// dnsNames returns the names pointing to the host, directly or through
+// cnames.
+func dnsNames(db *gorm.DB, hostID uint) ([]string, error) {
+	var names []string
+	if err := db.Model(&DnsRecord{}).Where("host_id = ?", hostID).Distinct().Pluck("name", &names).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, n := range names {
+		seen[n] = true
+	}
+	for next := names; len(next) > 0 && len(seen) < 1000; {
+		var aliases []string
+		if err := db.Model(&DnsRecord{}).Where("type = ? AND value IN ?", "CNAME", next).Distinct().Pluck("name", &aliases).Error; err != nil {
+			return nil, err
+		}
+		next = nil
+		for _, a := range aliases {
+			if !seen[a] {
+				seen[a] = true
+				names, next = append(names, a), append(next, a)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// orphanNames returns the names which do not resolve to a scanned host,
+// following cnames.
+func orphanNames(db *gorm.DB) ([]string, error) {
+	var records []DnsRecord
+	if err := db.Select("name", "type", "value", "host_id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	cnames := make(map[string][]string)
+	scanned := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, r := range records {
+		names[r.Name] = true
+		if r.HostID != nil {
+			scanned[r.Name] = true
+		}
+		if r.Type == "CNAME" {
+			cnames[r.Name] = append(cnames[r.Name], r.Value)
+		}
+	}
+	var resolves func(name string, depth int) bool
+	resolves = func(name string, depth int) bool {
+		if scanned[name] {
+			return true
+		}
+		if depth > 10 {
+			return false
+		}
+		for _, target := range cnames[name] {
+			if resolves(target, depth+1) {
+				return true
+			}
+		}
+		return false
+	}
+	var res []string
+	for name := range names {
+		if !resolves(name, 0) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func DnsRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/dns/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] DNS UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		source := r.URL.Query().Get("source")
+		if source == "" {
+			source = "upload"
+		}
+		p := &dnsParser{origin: dnsName(r.URL.Query().Get("origin"), "")}
+		var records []DnsRecord
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			for _, rec := range p.parseLine(scanner.Text()) {
+				rec.Source = source
+				records = append(records, rec)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := newScopeFilter(db, w, r.URL.Query().Get("scope") == "reject")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		read := len(records)
+		records = scopeDnsRecords(filter, records)
+		n, err := addDnsRecords(db, records)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("read %d records, %d new \nOK\n", read, n)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/dns", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		glob := strings.ToLower(r.URL.Query().Get("name"))
+		if _, err := path.Match(glob, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid name glob %q", glob), http.StatusBadRequest)
+			return
+		}
+		var records []DnsRecord
+		if err := db.Order("name, type, value").Find(&records).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, rec := range records {
+			if glob != "" {
+				if ok, _ := path.Match(glob, rec.Name); !ok {
+					continue
+				}
+			}
+			scanned := ""
+			if rec.HostID != nil {
+				scanned = "\tscanned"
+			}
+			res = res + fmt.Sprintf("%s\t%s\t%s%s\n", rec.Name, rec.Type, rec.Value, scanned)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/dns/orphans", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		names, err := orphanNames(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, name := range names {
+			res = res + fmt.Sprintf("%s\n", name)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/dns/unnamed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		var hosts []string
+		err := db.Model(&Host{}).Where("hostname = ''").
+			Where("id NOT IN (?)", db.Model(&DnsRecord{}).Select("host_id").Where("host_id IS NOT NULL")).
+			Order("ip").Pluck("ip", &hosts).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, host := range hosts {
+			res = res + fmt.Sprintf("%s\n", host)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"text/template"
 
@@ -148,8 +149,27 @@ func loadPage(title string) (*Page, error) {
 	return &Page{Title: title, Body: body}, nil
 }
 
+// wikiMacros expand [[name:argument]] in pages to markdown before rendering.
+var wikiMacros = map[string]func(string) string{
+	"ad":    adMacro,
+	"graph": graphMacro,
+}
+
+var macroRe = regexp.MustCompile(`\[\[([a-z]+):([^\]]+)\]\]`)
+
+func expandMacros(text string) string {
+	return macroRe.ReplaceAllStringFunc(text, func(m string) string {
+		parts := macroRe.FindStringSubmatch(m)
+		macro, ok := wikiMacros[parts[1]]
+		if !ok || database == nil {
+			return m
+		}
+		return macro(parts[2])
+	})
+}
+
 func renderMarkdown(rawMarkdown []byte) string {
-	toparse := string(rawMarkdown)
+	toparse := expandMacros(string(rawMarkdown))
 	unsafe := blackfriday.Run([]byte(strings.Replace(toparse, "\r\n", "\n", -1)))
 	html := string(bluemonday.UGCPolicy().SanitizeBytes(unsafe))
 	return html
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type Exploit struct {
+	gorm.Model
+	EdbID       string `gorm:"size:32;index"`
+	File        string
+	Description string
+	Type        string
+	Platform    string
+	Port        string
+	Date        string
+}
+
+var (
+	reExploitRange = regexp.MustCompile(`(\d+(?:\.[0-9x]+)*[a-z0-9]*)\s*(?:<|-|to)\s*(\d+(?:\.[0-9x]+)*[a-z0-9]*)`)
+	reExploitBound = regexp.MustCompile(`(<=|<|>=|>)\s*(\d+(?:\.[0-9x]+)*[a-z0-9]*)`)
+	reExploitVer   = regexp.MustCompile(`\b(\d+(?:\.[0-9x]+)+[a-z0-9]*)`)
+)
+
+// versionPrefix reports whether version starts with the tokens of prefix,
+// "2.4" and "2.4.x" both match "2.4.49".
+func versionPrefix(prefix, version string) bool {
+	tp := versionTokens(strings.ReplaceAll(prefix, "x", ""))
+	tv := versionTokens(version)
+	if len(tp) == 0 || len(tp) > len(tv) {
+		return false
+	}
+	for i := range tp {
+		if tp[i] != tv[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// exploitMatchVersion checks the version expressions found in an exploit
+// title, searchsploit titles use "< X" loosely so bounds are inclusive.
+func exploitMatchVersion(title, version string) bool {
+	title = strings.ToLower(title)
+	if i := strings.Index(title, " - "); i != -1 {
+		title = title[:i]
+	}
+	for _, m := range reExploitRange.FindAllStringSubmatch(title, -1) {
+		if versionCmp(version, m[1]) >= 0 && (versionCmp(version, m[2]) <= 0 || versionPrefix(m[2], version)) {
+			return true
+		}
+	}
+	title = reExploitRange.ReplaceAllString(title, "")
+	for _, m := range reExploitBound.FindAllStringSubmatch(title, -1) {
+		c := versionCmp(version, m[2])
+		if (strings.HasPrefix(m[1], "<") && c <= 0) || (strings.HasPrefix(m[1], ">") && c >= 0) {
+			return true
+		}
+	}
+	title = reExploitBound.ReplaceAllString(title, "")
+	for _, m := range reExploitVer.FindAllStringSubmatch(title, -1) {
+		if versionCmp(version, m[1]) == 0 || versionPrefix(m[1], version) {
+			return true
+		}
+	}
+	return false
+}
+
+type exploitMatcher struct {
+	db    *gorm.DB
+	cache map[string][]Exploit
+}
+
+func newExploitMatcher(db *gorm.DB) *exploitMatcher {
+	return &exploitMatcher{db: db, cache: make(map[string][]Exploit)}
+}
+
+// likeEscape escapes the LIKE wildcards in a term taken from scan data, the
+// escape character is passed as a parameter so every driver quotes it.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (m *exploitMatcher) candidates(term string) ([]Exploit, error) {
+	if res, ok := m.cache[term]; ok {
+		return res, nil
+	}
+	var res []Exploit
+	err := m.db.Where("LOWER(description) LIKE ? ESCAPE ?", "%"+likeEscape(term)+"%", `\`).Order("edb_id").Find(&res).Error
+	if err != nil {
+		return nil, err
+	}
+	m.cache[term] = res
+	return res, nil
+}
+
+func (m *exploitMatcher) Match(port *Port) ([]Exploit, error) {
+	product := strings.ToLower(strings.TrimSpace(port.Product))
+	fields := strings.Fields(port.Version)
+	if product == "" || len(fields) == 0 {
+		return nil, nil
+	}
+	version := fields[0]
+
+	cands, err := m.candidates(product)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Exploit
+	for _, e := range cands {
+		if exploitMatchVersion(e.Description, version) {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+func importExploitDb(w io.Writer, db *gorm.DB, r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"id", "file", "description"} {
+		if _, ok := cols[name]; !ok {
+			return fmt.Errorf("missing column %s", name)
+		}
+	}
+	get := func(rec []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+
+	var batch []Exploit
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		date := get(rec, "date_published")
+		if date == "" {
+			date = get(rec, "date")
+		}
+		batch = append(batch, Exploit{
+			EdbID:       get(rec, "id"),
+			File:        get(rec, "file"),
+			Description: get(rec, "description"),
+			Type:        get(rec, "type"),
+			Platform:    get(rec, "platform"),
+			Port:        get(rec, "port"),
+			Date:        date,
+		})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("1 = 1").Delete(&Exploit{}).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(batch, 500).Error
+	})
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(fmt.Sprintf("imported %d exploits \n", len(batch))))
+	return nil
+}
+
+func formatExploit(e Exploit) string {
+	return fmt.Sprintf("EDB-%s %s %s", e.EdbID, e.Description, e.File)
+}
+
+func ExploitRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/exploits/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] EXPLOITDB UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		if err := importExploitDb(w, db, r.Body); err != nil {
+			w.Write([]byte(fmt.Sprintf("unable to import exploitdb csv : %v\nNOK\n", err)))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/show/{ip}/exploits", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		ip := mux.Vars(r)["ip"]
+		var host Host
+		if err := db.Preload("Ports").Take(&host, "IP = ?", ip).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		sort.Slice(host.Ports, func(i, j int) bool { return host.Ports[i].Port < host.Ports[j].Port })
+		matcher := newExploitMatcher(db)
+		res := ""
+		for _, port := range host.Ports {
+			exploits, err := matcher.Match(&port)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(exploits) == 0 {
+				continue
+			}
+			res = res + fmt.Sprintf("%d/%s %s %s\n", port.Port, port.Protocol, port.Product, port.Version)
+			for _, e := range exploits {
+				res = res + fmt.Sprintf("\t%s\n", formatExploit(e))
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/exploits", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		rows, err := hostPorts(db, "1 = 1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		matcher := newExploitMatcher(db)
+		res := ""
+		for _, row := range rows {
+			port := row.Port
+			exploits, err := matcher.Match(&port)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, e := range exploits {
+				res = res + fmt.Sprintf("%s/%s\t%s %s\t%s\n", net.JoinHostPort(row.IP, strconv.Itoa(int(port.Port))), port.Protocol, port.Product, port.Version, formatExploit(e))
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestExploitMatchVersion(t *testing.T) {
+	tests := []struct {
+		title   string
+		version string
+		want    bool
+	}{
+		{"vsftpd 2.3.4 - Backdoor Command Execution", "2.3.4", true},
+		{"vsftpd 2.3.4 - Backdoor Command Execution", "2.3.5", false},
+		{"OpenSSH < 7.7 - User Enumeration", "7.4", true},
+		{"OpenSSH < 7.7 - User Enumeration", "8.0", false},
+		{"Apache Tomcat 9.0.0 < 9.0.30 - Information Disclosure", "9.0.30", true},
+		{"Apache Tomcat 9.0.0 < 9.0.30 - Information Disclosure", "9.0.31", false},
+		{"Apache Tomcat 7.0.x - Denial of Service", "7.0.52", true},
+		{"nginx 1.4.0 (Generic Linux x64) - Remote Overflow", "1.4.0", true},
+		{"Samba >= 3.5.0 - Remote Code Execution", "4.5.16", true},
+		{"Samba >= 3.5.0 - Remote Code Execution", "3.4.0", false},
+		{"ProFTPd - mod_copy Command Execution", "1.3.5", false},
+		{"Exim 4.87 < 4.91 - Local Privilege Escalation (2.4 kernel)", "2.4.41", false},
+	}
+	for _, tt := range tests {
+		if got := exploitMatchVersion(tt.title, tt.version); got != tt.want {
+			t.Errorf("exploitMatchVersion(%q, %q) = %v, want %v", tt.title, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestExploitMatcher(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "gorm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(Exploit{}); err != nil {
+		t.Fatal(err)
+	}
+	exploits := []Exploit{
+		{EdbID: "1", Description: "Apache Struts 2.0.0 < 2.5.10 - Remote Code Execution"},
+		{EdbID: "2", Description: "Apache OFBiz 2 < 17.12 - Remote Code Execution"},
+		{EdbID: "3", Description: "Apache Tomcat 9.0.0 < 9.0.31 - File Read"},
+		{EdbID: "4", Description: "ng_nx 1.18.0 - Literal Underscore"},
+	}
+	if err := db.Create(&exploits).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		product string
+		version string
+		want    []string
+	}{
+		// only the first word matches, apache struts and ofbiz must not be reported
+		{"Apache httpd", "2.4.41", nil},
+		{"Apache Tomcat", "9.0.30", []string{"3"}},
+		{"Apache Tomcat", "9.0.32", nil},
+		// the underscore is not a LIKE wildcard
+		{"nginx", "1.18.0", nil},
+		{"ng_nx", "1.18.0", []string{"4"}},
+		{"ng%x", "1.18.0", nil},
+	}
+	matcher := newExploitMatcher(db)
+	for _, tt := range tests {
+		res, err := matcher.Match(&Port{Product: tt.product, Version: tt.version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range res {
+			got = append(got, e.EdbID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Match(%q %q) = %v, want %v", tt.product, tt.version, got, tt.want)
+		}
+	}
+}
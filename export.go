@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type msfService struct {
+	Port  uint   `xml:"port"`
+	Proto string `xml:"proto"`
+	State string `xml:"state"`
+	Name  string `xml:"name"`
+	Info  string `xml:"info"`
+}
+
+type msfHost struct {
+	Address  string       `xml:"address"`
+	Name     string       `xml:"name,omitempty"`
+	State    string       `xml:"state"`
+	Services []msfService `xml:"services>service"`
+}
+
+type msfExport struct {
+	XMLName   xml.Name `xml:"MetasploitV4"`
+	Generated struct {
+		Time    string `xml:"time,attr"`
+		User    string `xml:"user,attr"`
+		Project string `xml:"project,attr"`
+		Product string `xml:"product,attr"`
+	} `xml:"generated"`
+	Hosts []msfHost `xml:"hosts>host"`
+}
+
+// rowUrl returns the web url of a port, https when nmap saw a ssl tunnel.
+func rowUrl(row *QueryRow) (string, bool) {
+	service := strings.ToLower(row.Service)
+	if !strings.Contains(service, "http") {
+		return "", false
+	}
+	scheme := "http"
+	if row.Tunnel == "ssl" || service == "https" || strings.HasPrefix(service, "ssl/") || strings.HasSuffix(service, "https") {
+		scheme = "https"
+	}
+	if (scheme == "http" && row.Port == 80) || (scheme == "https" && row.Port == 443) {
+		if strings.Contains(row.IP, ":") {
+			return fmt.Sprintf("%s://[%s]", scheme, row.IP), true
+		}
+		return fmt.Sprintf("%s://%s", scheme, row.IP), true
+	}
+	return fmt.Sprintf("%s://%s", scheme, row.Addr()), true
+}
+
+func uniqueLines(lines []string) string {
+	seen := make(map[string]bool)
+	res := ""
+	for _, line := range lines {
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		res = res + line + "\n"
+	}
+	return res
+}
+
+func exportMsf(rows []QueryRow) ([]byte, error) {
+	var doc msfExport
+	doc.Generated.Time = time.Now().UTC().Format("2006-01-02 15:04:05 UTC")
+	doc.Generated.User = "wikix"
+	doc.Generated.Project = "default"
+	doc.Generated.Product = "framework"
+
+	byIP := make(map[string]*msfHost)
+	var order []string
+	for _, row := range rows {
+		host, ok := byIP[row.IP]
+		if !ok {
+			host = &msfHost{Address: row.IP, Name: row.Hostname, State: "alive"}
+			byIP[row.IP] = host
+			order = append(order, row.IP)
+		}
+		host.Services = append(host.Services, msfService{
+			Port:  row.Port,
+			Proto: row.Protocol,
+			State: row.State,
+			Name:  row.Service,
+			Info:  strings.TrimSpace(row.Product + " " + row.Version),
+		})
+	}
+	for _, ip := range order {
+		doc.Hosts = append(doc.Hosts, *byIP[ip])
+	}
+	res, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), res...), nil
+}
+
+type exportScript struct {
+	IP       string
+	Port     uint
+	Protocol string
+	Title    string
+	Output   string
+}
+
+// exportScripts returns the scripts of the exported ports and of their
+// hosts, host scripts come first with port 0.
+func exportScripts(db *gorm.DB, rows []QueryRow) ([]exportScript, error) {
+	selected := make(map[string]bool)
+	var ips []string
+	for _, row := range rows {
+		if !selected[row.IP] {
+			selected[row.IP] = true
+			ips = append(ips, row.IP)
+		}
+		selected[fmt.Sprintf("%s %d/%s", row.IP, row.Port, row.Protocol)] = true
+	}
+	var res []exportScript
+	for len(ips) > 0 {
+		n := min(len(ips), 500)
+		var hostScripts, portScripts []exportScript
+		err := db.Table("scripts").Select("hosts.ip, scripts.title, scripts.output").
+			Joins("JOIN hosts ON hosts.id = scripts.host_id AND hosts.deleted_at IS NULL").
+			Where("hosts.ip IN ? AND scripts.deleted_at IS NULL", ips[:n]).
+			Order("hosts.ip, scripts.title").Scan(&hostScripts).Error
+		if err != nil {
+			return nil, err
+		}
+		err = db.Table("scripts").Select("hosts.ip, ports.port, ports.protocol, scripts.title, scripts.output").
+			Joins("JOIN ports ON ports.id = scripts.port_id AND ports.deleted_at IS NULL").
+			Joins("JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL").
+			Where("hosts.ip IN ? AND scripts.deleted_at IS NULL", ips[:n]).
+			Order("hosts.ip, ports.port, scripts.title").Scan(&portScripts).Error
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, hostScripts...)
+		for _, s := range portScripts {
+			if selected[fmt.Sprintf("%s %d/%s", s.IP, s.Port, s.Protocol)] {
+				res = append(res, s)
+			}
+		}
+		ips = ips[n:]
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].IP != res[j].IP {
+			return res[i].IP < res[j].IP
+		}
+		return res[i].Port < res[j].Port
+	})
+	return res, nil
+}
+
+// csvCell keeps a spreadsheet from reading a scan derived value as a
+// formula, a leading = + - @ tab or carriage return gets a quote.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportSheets builds the hosts, open ports, services and scripts views of
+// the spreadsheet exports, the first row of each view is the header.
+func exportSheets(rows []QueryRow, scripts []exportScript) []xlsxSheet {
+	hosts := xlsxSheet{Name: "hosts", Rows: [][]any{{"ip", "hostname", "open ports", "ports", "first seen", "last seen"}}}
+	ports := xlsxSheet{Name: "open ports", Rows: [][]any{{"ip", "hostname", "port", "protocol", "state", "service", "product", "version", "first seen", "last seen"}}}
+	services := xlsxSheet{Name: "services", Rows: [][]any{{"service", "product", "version", "hosts", "ports"}}}
+
+	type hostSum struct {
+		row   QueryRow
+		ports []string
+	}
+	type serviceSum struct {
+		hosts map[string]bool
+		ports map[uint]bool
+	}
+	var hostOrder, serviceOrder []string
+	byHost := make(map[string]*hostSum)
+	byService := make(map[string]*serviceSum)
+
+	for _, row := range rows {
+		ports.Rows = append(ports.Rows, []any{row.IP, row.Hostname, row.Port, row.Protocol, row.State, row.Service, row.Product, row.Version, row.FirstSeen, row.LastSeen})
+
+		h, ok := byHost[row.IP]
+		if !ok {
+			h = &hostSum{row: row}
+			byHost[row.IP] = h
+			hostOrder = append(hostOrder, row.IP)
+		}
+		h.ports = append(h.ports, fmt.Sprintf("%d/%s", row.Port, row.Protocol))
+
+		key := strings.Join([]string{row.Service, row.Product, row.Version}, "\x00")
+		sv, ok := byService[key]
+		if !ok {
+			sv = &serviceSum{hosts: make(map[string]bool), ports: make(map[uint]bool)}
+			byService[key] = sv
+			serviceOrder = append(serviceOrder, key)
+		}
+		sv.hosts[row.IP] = true
+		sv.ports[row.Port] = true
+	}
+
+	for _, ip := range hostOrder {
+		h := byHost[ip]
+		hosts.Rows = append(hosts.Rows, []any{ip, h.row.Hostname, len(h.ports), strings.Join(h.ports, " "), h.row.FirstSeen, h.row.LastSeen})
+	}
+
+	sort.SliceStable(serviceOrder, func(i, j int) bool {
+		return len(byService[serviceOrder[i]].hosts) > len(byService[serviceOrder[j]].hosts)
+	})
+	for _, key := range serviceOrder {
+		sv := byService[key]
+		var list []string
+		for p := range sv.ports {
+			list = append(list, strconv.Itoa(int(p)))
+		}
+		sort.Slice(list, func(i, j int) bool {
+			a, _ := strconv.Atoi(list[i])
+			b, _ := strconv.Atoi(list[j])
+			return a < b
+		})
+		fields := strings.Split(key, "\x00")
+		services.Rows = append(services.Rows, []any{fields[0], fields[1], fields[2], len(sv.hosts), strings.Join(list, " ")})
+	}
+
+	scriptSheet := xlsxSheet{Name: "scripts", Rows: [][]any{{"ip", "port", "protocol", "script", "output"}}}
+	for _, s := range scripts {
+		scriptSheet.Rows = append(scriptSheet.Rows, []any{s.IP, s.Port, s.Protocol, s.Title, s.Output})
+	}
+	return []xlsxSheet{hosts, ports, services, scriptSheet}
+}
+
+func ExportRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/export/{format}", func(w http.ResponseWriter, r *http.Request) {
+		format := mux.Vars(r)["format"]
+		values := r.URL.Query()
+		if values.Get("state") == "" {
+			values.Set("state", "open")
+		}
+		values.Del("format")
+		q, err := ParseNmapQuery(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, _, err := q.Run(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var lines []string
+		switch format {
+		case "urls":
+			for _, row := range rows {
+				if u, ok := rowUrl(&row); ok {
+					lines = append(lines, u)
+				}
+			}
+		case "ipport":
+			for _, row := range rows {
+				lines = append(lines, row.Addr())
+			}
+		case "hosts":
+			for _, row := range rows {
+				lines = append(lines, row.IP)
+			}
+		case "etchosts":
+			var hosts []Host
+			if err := db.Select("ip", "hostname").Where("hostname <> ''").Order("ip").Find(&hosts).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			selected := make(map[string]bool)
+			for _, row := range rows {
+				selected[row.IP] = true
+			}
+			for _, host := range hosts {
+				if selected[host.IP] {
+					lines = append(lines, fmt.Sprintf("%s\t%s", host.IP, host.Hostname))
+				}
+			}
+		case "csv":
+			view := r.URL.Query().Get("view")
+			var scripts []exportScript
+			if view == "scripts" {
+				if scripts, err = exportScripts(db, rows); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			sheets := exportSheets(rows, scripts)
+			sheet := sheets[1]
+			switch view {
+			case "hosts":
+				sheet = sheets[0]
+			case "services":
+				sheet = sheets[2]
+			case "scripts":
+				sheet = sheets[3]
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=wikix.%s.%d.csv", strings.ReplaceAll(sheet.Name, " ", "_"), time.Now().Unix()))
+			cw := csv.NewWriter(w)
+			for _, row := range sheet.Rows {
+				var record []string
+				for _, v := range row {
+					switch val := v.(type) {
+					case time.Time:
+						v = val.Format(time.RFC3339)
+					case string:
+						v = csvCell(val)
+					}
+					record = append(record, fmt.Sprint(v))
+				}
+				cw.Write(record)
+			}
+			cw.Flush()
+			return
+		case "xlsx":
+			scripts, err := exportScripts(db, rows)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=wikix.%d.xlsx", time.Now().Unix()))
+			if err := writeXlsx(w, exportSheets(rows, scripts)); err != nil {
+				log.Printf("xlsx export error %v", err)
+			}
+			return
+		case "msf":
+			res, err := exportMsf(rows)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=wikix.msf.%d.xml", time.Now().Unix()))
+			w.Write(res)
+			return
+		default:
+			http.Error(w, fmt.Sprintf("unknown export %s", format), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(uniqueLines(lines)))
+	}).Methods("GET")
+}
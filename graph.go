@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	graphPad      = 20
+	graphHostW    = 150
+	graphGap      = 10
+	graphLineH    = 14
+	graphRouterW  = 140
+	graphRouterH  = 34
+	graphLevelGap = 50
+	graphWidth    = 1200
+	graphServices = 4
+)
+
+var graphStatusFill = map[string]string{
+	StatusUntested: "#ffffff",
+	StatusProgress: "#fff3cd",
+	StatusDone:     "#d1e7dd",
+	StatusNA:       "#e9ecef",
+}
+
+type graphRect struct {
+	X, Y, W, H int
+}
+
+type graphHost struct {
+	graphRect
+	subnetHost
+	Services []string
+}
+
+type graphSubnet struct {
+	graphRect
+	Prefix netip.Prefix
+	Hosts  []*graphHost
+}
+
+type graphRouter struct {
+	graphRect
+	IP    string
+	Name  string
+	Level int
+}
+
+type graphEdge struct {
+	From string
+	To   string
+}
+
+// Graph is a laid out network map, routers come from the traceroutes and
+// sit above the subnets by hop distance.
+type Graph struct {
+	Width   int
+	Height  int
+	Subnets []*graphSubnet
+	Routers []*graphRouter
+	Edges   []graphEdge
+}
+
+func graphClip(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// graphTraces returns the routers before each host, ordered by ttl.
+func graphTraces(db *gorm.DB, ips []string) (map[string][]Hop, error) {
+	res := make(map[string][]Hop)
+	for len(ips) > 0 {
+		n := min(len(ips), 500)
+		var hops []struct {
+			Hop
+			HostIP string
+		}
+		err := db.Table("hops").Select("hops.*, hosts.ip AS host_ip").
+			Joins("JOIN hosts ON hosts.id = hops.host_id").
+			Where("hosts.ip IN ? AND hops.ip <> hosts.ip AND hops.deleted_at IS NULL AND hosts.deleted_at IS NULL", ips[:n]).
+			Order("hops.host_id, hops.ttl").Scan(&hops).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, hop := range hops {
+			res[hop.HostIP] = append(res[hop.HostIP], hop.Hop)
+		}
+		ips = ips[n:]
+	}
+	return res, nil
+}
+
+func buildGraph(db *gorm.DB, rows []QueryRow, bits int) (*Graph, error) {
+	services := make(map[string][]string)
+	hosts := make(map[string]*subnetHost)
+	var ips []string
+	for _, row := range rows {
+		h, ok := hosts[row.IP]
+		if !ok {
+			h = &subnetHost{IP: row.IP, Hostname: row.Hostname}
+			hosts[row.IP] = h
+			ips = append(ips, row.IP)
+		}
+		h.Open++
+		services[row.IP] = append(services[row.IP], fmt.Sprintf("%d/%s %s", row.Port, row.Protocol, row.Service))
+	}
+	for len(ips) > 0 {
+		n := min(len(ips), 500)
+		var status []Host
+		if err := db.Select("ip", "status").Where("ip IN ?", ips[:n]).Find(&status).Error; err != nil {
+			return nil, err
+		}
+		for _, s := range status {
+			if h, ok := hosts[s.IP]; ok {
+				h.Status = s.Status
+			}
+		}
+		ips = ips[n:]
+	}
+
+	var selected []subnetHost
+	for ip, h := range hosts {
+		selected = append(selected, *h)
+		ips = append(ips, ip)
+	}
+	traces, err := graphTraces(db, ips)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Graph{}
+	x, y, shelf := graphPad, 0, 0
+	for _, subnet := range GroupSubnets(selected, bits) {
+		gs := &graphSubnet{Prefix: subnet.Prefix}
+		cols := min(int(math.Ceil(math.Sqrt(float64(len(subnet.Hosts))))), 6)
+		gs.W = cols*(graphHostW+graphGap) + graphGap
+		gs.H = 26
+		for i := 0; i < len(subnet.Hosts); i += cols {
+			rowH := 0
+			for j := i; j < min(i+cols, len(subnet.Hosts)); j++ {
+				gh := &graphHost{subnetHost: subnet.Hosts[j]}
+				list := services[gh.IP]
+				if len(list) > graphServices {
+					list = append(list[:graphServices:graphServices], fmt.Sprintf("+%d more", len(list)-graphServices))
+				}
+				gh.Services = list
+				gh.X = graphGap + (j-i)*(graphHostW+graphGap)
+				gh.Y = gs.H
+				gh.W = graphHostW
+				gh.H = graphLineH*(2+len(list)) + 8
+				rowH = max(rowH, gh.H)
+				gs.Hosts = append(gs.Hosts, gh)
+			}
+			gs.H += rowH + graphGap
+		}
+		if x > graphPad && x+gs.W > graphWidth {
+			x, y, shelf = graphPad, y+shelf+graphLevelGap, 0
+		}
+		gs.X, gs.Y = x, y
+		x += gs.W + graphGap*3
+		shelf = max(shelf, gs.H)
+		g.Width = max(g.Width, gs.X+gs.W+graphPad)
+		g.Subnets = append(g.Subnets, gs)
+	}
+
+	routers := make(map[string]*graphRouter)
+	seen := make(map[graphEdge]bool)
+	addEdge := func(e graphEdge) {
+		if !seen[e] {
+			seen[e] = true
+			g.Edges = append(g.Edges, e)
+		}
+	}
+	levels := 0
+	for _, gs := range g.Subnets {
+		for _, gh := range gs.Hosts {
+			hops := traces[gh.IP]
+			for i, hop := range hops {
+				r, ok := routers[hop.IP]
+				if !ok {
+					r = &graphRouter{IP: hop.IP, Name: hop.Name, Level: i + 1}
+					routers[hop.IP] = r
+				}
+				r.Level = min(r.Level, i+1)
+				levels = max(levels, r.Level)
+				if i > 0 {
+					addEdge(graphEdge{From: hops[i-1].IP, To: hop.IP})
+				}
+			}
+			if len(hops) > 0 {
+				addEdge(graphEdge{From: hops[len(hops)-1].IP, To: gs.Prefix.String()})
+			}
+		}
+	}
+
+	band := levels * (graphRouterH + graphLevelGap)
+	for _, gs := range g.Subnets {
+		gs.Y += graphPad + band
+		g.Height = max(g.Height, gs.Y+gs.H+graphPad)
+	}
+	g.Width = max(g.Width, graphRouterW+2*graphPad)
+	g.Height = max(g.Height, band+graphPad)
+
+	for _, r := range routers {
+		g.Routers = append(g.Routers, r)
+	}
+	sort.Slice(g.Routers, func(i, j int) bool {
+		if g.Routers[i].Level != g.Routers[j].Level {
+			return g.Routers[i].Level < g.Routers[j].Level
+		}
+		a, _ := netip.ParseAddr(g.Routers[i].IP)
+		b, _ := netip.ParseAddr(g.Routers[j].IP)
+		return a.Less(b)
+	})
+	for i := 0; i < len(g.Routers); {
+		j := i
+		for j < len(g.Routers) && g.Routers[j].Level == g.Routers[i].Level {
+			j++
+		}
+		step := g.Width / (j - i + 1)
+		for k, r := range g.Routers[i:j] {
+			r.W, r.H = graphRouterW, graphRouterH
+			r.X = step*(k+1) - graphRouterW/2
+			r.Y = graphPad + (r.Level-1)*(graphRouterH+graphLevelGap)
+		}
+		i = j
+	}
+	return g, nil
+}
+
+func (g *Graph) node(name string) graphRect {
+	for _, r := range g.Routers {
+		if r.IP == name {
+			return r.graphRect
+		}
+	}
+	for _, s := range g.Subnets {
+		if s.Prefix.String() == name {
+			return s.graphRect
+		}
+	}
+	return graphRect{}
+}
+
+func (g *Graph) SVG() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n", g.Width, g.Height, g.Width, g.Height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#ffffff"/>`+"\n")
+	for _, e := range g.Edges {
+		from, to := g.node(e.From), g.node(e.To)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#6c757d" stroke-width="1"/>`+"\n", from.X+from.W/2, from.Y+from.H, to.X+to.W/2, to.Y)
+	}
+	for _, r := range g.Routers {
+		fmt.Fprintf(&b, `<a href="/nmap/host/%s"><rect x="%d" y="%d" width="%d" height="%d" rx="12" fill="#cfe2ff" stroke="#0d6efd"/>`, url.PathEscape(r.IP), r.X, r.Y, r.W, r.H)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" font-weight="bold">%s</text>`, r.X+r.W/2, r.Y+14, xmlAttr(r.IP))
+		if r.Name != "" {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" fill="#495057">%s</text>`, r.X+r.W/2, r.Y+28, xmlAttr(graphClip(r.Name, 22)))
+		}
+		b.WriteString("</a>\n")
+	}
+	for _, s := range g.Subnets {
+		fmt.Fprintf(&b, `<g transform="translate(%d,%d)">`+"\n", s.X, s.Y)
+		fmt.Fprintf(&b, `<rect width="%d" height="%d" rx="6" fill="#f8f9fa" stroke="#adb5bd"/>`+"\n", s.W, s.H)
+		fmt.Fprintf(&b, `<text x="%d" y="17" font-weight="bold">%s</text><text x="%d" y="17" text-anchor="end" fill="#6c757d">%d hosts</text>`+"\n", graphGap, s.Prefix, s.W-graphGap, len(s.Hosts))
+		for _, h := range s.Hosts {
+			fill, ok := graphStatusFill[h.Status]
+			if !ok {
+				fill = graphStatusFill[StatusUntested]
+			}
+			fmt.Fprintf(&b, `<a href="/nmap/host/%s"><rect x="%d" y="%d" width="%d" height="%d" rx="3" fill="%s" stroke="#6c757d"/>`, url.PathEscape(h.IP), h.X, h.Y, h.W, h.H, fill)
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-weight="bold">%s</text>`, h.X+5, h.Y+graphLineH, xmlAttr(h.IP))
+			fmt.Fprintf(&b, `<text x="%d" y="%d" fill="#495057">%s</text>`, h.X+5, h.Y+2*graphLineH, xmlAttr(graphClip(h.Hostname, 24)))
+			for i, svc := range h.Services {
+				fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10">%s</text>`, h.X+5, h.Y+(3+i)*graphLineH, xmlAttr(graphClip(svc, 26)))
+			}
+			b.WriteString("</a>\n")
+		}
+		b.WriteString("</g>\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// graphMacro renders [[graph:query]] as the svg for the query, with the
+// parameters of /nmap/graph.svg. Every key and value is escaped again so
+// it stays within the link.
+func graphMacro(arg string) string {
+	values, err := url.ParseQuery(strings.TrimSpace(arg))
+	if err != nil {
+		return fmt.Sprintf("`%s` (invalid graph query)", strings.TrimSpace(arg))
+	}
+	return fmt.Sprintf("![network graph](/nmap/graph.svg?%s)", values.Encode())
+}
+
+func GraphRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/graph.svg", func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		if values.Get("state") == "" {
+			values.Set("state", "open")
+		}
+		bits, err := parsePrefixLen(values.Get("prefix"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values.Del("format")
+		values.Del("limit")
+		q, err := ParseNmapQuery(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, _, err := q.Run(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g, err := buildGraph(db, rows, bits)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(g.SVG())
+	}).Methods("GET")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/gorm"
+)
+
+// Hop is a traceroute hop towards a host, the last one is usually the host
+// itself.
+type Hop struct {
+	gorm.Model
+	HostID uint    `gorm:"index"`
+	TTL    int     `gorm:"column:ttl"`
+	IP     string  `gorm:"size:64;index"`
+	RTT    float64 `gorm:"column:rtt"`
+	Name   string
+}
+
+func traceHops(trace nmap.Trace) []Hop {
+	var hops []Hop
+	for _, hop := range trace.Hops {
+		if hop.IPAddr == "" {
+			continue
+		}
+		hops = append(hops, Hop{TTL: int(hop.TTL), IP: hop.IPAddr, RTT: float64(hop.RTT), Name: hop.Host})
+	}
+	return hops
+}
+
+type routerHop struct {
+	IP   string
+	Name string
+}
+
+// routerHops returns the hops seen on the way to another host.
+func routerHops(db *gorm.DB) ([]routerHop, error) {
+	var hops []routerHop
+	err := db.Table("hops").Select("hops.ip, MAX(hops.name) AS name").
+		Joins("JOIN hosts ON hosts.id = hops.host_id").
+		Where("hops.ip <> hosts.ip AND hops.deleted_at IS NULL AND hosts.deleted_at IS NULL").
+		Group("hops.ip").Scan(&hops).Error
+	return hops, err
+}
+
+// markRouters flags the hosts seen as an intermediate hop and adds the
+// routers that were not scanned as hosts of their own, the routers go
+// through the scope filter like the scanned hosts.
+func markRouters(db *gorm.DB, filter *scopeFilter, scanID uint) (int, error) {
+	all, err := routerHops(db)
+	if err != nil {
+		return 0, err
+	}
+	var hops []routerHop
+	var ips []string
+	for _, hop := range all {
+		if _, err := netip.ParseAddr(hop.IP); err != nil {
+			continue
+		}
+		hops = append(hops, hop)
+		ips = append(ips, hop.IP)
+	}
+	known := make(map[string]bool)
+	for batch := ips; len(batch) > 0; {
+		n := min(len(batch), 500)
+		var found []string
+		if err := db.Model(&Host{}).Where("ip IN ?", batch[:n]).Pluck("ip", &found).Error; err != nil {
+			return 0, err
+		}
+		for _, ip := range found {
+			known[ip] = true
+		}
+		if err := db.Model(&Host{}).Where("ip IN ? AND router = ?", batch[:n], false).Update("router", true).Error; err != nil {
+			return 0, err
+		}
+		batch = batch[n:]
+	}
+
+	var added []Host
+	var addedIPs []string
+	for _, hop := range hops {
+		if known[hop.IP] {
+			continue
+		}
+		if !filter.Keep("router "+hop.IP, hop.IP, hop.Name) {
+			continue
+		}
+		added = append(added, Host{IP: hop.IP, Hostname: hop.Name, ScanID: scanID, Router: true})
+		addedIPs = append(addedIPs, hop.IP)
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	if err := db.CreateInBatches(added, 200).Error; err != nil {
+		return 0, err
+	}
+	return len(added), recordScanHosts(db, scanID, addedIPs)
+}
+
+// routerOnly tells if ip was only seen as a router, such a host is completed
+// by a later scan instead of being skipped as already known.
+func routerOnly(db *gorm.DB, ip string) (bool, error) {
+	var n int64
+	err := db.Model(&Host{}).Where("ip = ? AND router = ? AND raw IS NULL", ip, true).Count(&n).Error
+	return n > 0, err
+}
+
+type behindHost struct {
+	IP       string
+	Hostname string
+	TTL      int
+	Last     int
+}
+
+func hostsBehind(db *gorm.DB, ip string) ([]behindHost, error) {
+	var rows []behindHost
+	err := db.Table("hops").
+		Select("hosts.ip, hosts.hostname, hops.ttl, trace.last").
+		Joins("JOIN hosts ON hosts.id = hops.host_id").
+		Joins("JOIN (SELECT host_id, MAX(ttl) AS last FROM hops WHERE deleted_at IS NULL GROUP BY host_id) trace ON trace.host_id = hosts.id").
+		Where("hops.ip = ? AND hosts.ip <> ? AND hops.deleted_at IS NULL AND hosts.deleted_at IS NULL", ip, ip).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	byIP := make(map[string]int)
+	var hosts []behindHost
+	for _, row := range rows {
+		if i, ok := byIP[row.IP]; ok {
+			hosts[i].TTL = min(hosts[i].TTL, row.TTL)
+			continue
+		}
+		byIP[row.IP] = len(hosts)
+		hosts = append(hosts, row)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		a, _ := netip.ParseAddr(hosts[i].IP)
+		b, _ := netip.ParseAddr(hosts[j].IP)
+		return a.Less(b)
+	})
+	return hosts, nil
+}
+
+func HopRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/behind/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		hosts, err := hostsBehind(db, mux.Vars(r)["ip"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		direct := r.URL.Query().Get("direct") != ""
+		res := ""
+		for _, h := range hosts {
+			between := h.Last - h.TTL - 1
+			if direct && between > 0 {
+				continue
+			}
+			res = res + fmt.Sprintf("%s\t%s\thops=%d\n", h.IP, h.Hostname, between)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/trace/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		var host Host
+		if err := db.Preload("Hops", func(tx *gorm.DB) *gorm.DB { return tx.Order("ttl") }).Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		res := ""
+		for _, hop := range host.Hops {
+			res = res + fmt.Sprintf("%d\t%s\t%.2fms\t%s\n", hop.TTL, hop.IP, hop.RTT, hop.Name)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/gorm"
+)
+
+type HostPort struct {
+	Port
+	Cves        []Cve
+	Exploits    []Exploit
+	Endpoints   []WebEndpoint
+	Screenshots []Screenshot
+}
+
+func (p *HostPort) SiteMap() string {
+	return siteMap(p.Endpoints)
+}
+
+func (p *HostPort) Findings() int {
+	return len(p.Cves) + len(p.Exploits)
+}
+
+type HostView struct {
+	Host        Host
+	Hostnames   []string
+	OS          []string
+	Scope       string
+	Ports       []HostPort
+	HostScripts []nmap.Script
+	Certs       []Cert
+	Pages       []string
+	Behind      int
+	Statuses    []string
+	Prev        string
+	Next        string
+}
+
+// pagesMentioning returns the wiki pages containing one of the terms as a
+// whole word, 10.0.0.5 does not match 10.0.0.50.
+func pagesMentioning(terms []string) ([]string, error) {
+	var patterns []string
+	for _, term := range terms {
+		if term != "" {
+			patterns = append(patterns, regexp.QuoteMeta(strings.ToLower(term)))
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	re := regexp.MustCompile(`(^|[^0-9a-z.\-])(` + strings.Join(patterns, "|") + `)($|[^0-9a-z\-])`)
+
+	files, err := listAll(config["pages"])
+	if err != nil {
+		return nil, err
+	}
+	var pages []string
+	for _, file := range files {
+		content, err := os.ReadFile(config["pages"] + file)
+		if err != nil {
+			return nil, err
+		}
+		if re.Match([]byte(strings.ToLower(string(content)))) {
+			pages = append(pages, strings.TrimSuffix(file, filepath.Ext(file)))
+		}
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
+
+// hostNeighbours returns the hosts before and after ip in address order.
+func hostNeighbours(db *gorm.DB, ip string) (string, string, error) {
+	var ips []string
+	if err := db.Model(&Host{}).Pluck("ip", &ips).Error; err != nil {
+		return "", "", err
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		a, errA := netip.ParseAddr(ips[i])
+		b, errB := netip.ParseAddr(ips[j])
+		if errA != nil || errB != nil {
+			return ips[i] < ips[j]
+		}
+		return a.Less(b)
+	})
+	prev, next := "", ""
+	for i, v := range ips {
+		if v != ip {
+			continue
+		}
+		if i > 0 {
+			prev = ips[i-1]
+		}
+		if i < len(ips)-1 {
+			next = ips[i+1]
+		}
+	}
+	return prev, next, nil
+}
+
+func BuildHostView(db *gorm.DB, ip string) (*HostView, error) {
+	v := &HostView{Statuses: testStatuses}
+	if err := db.Preload("Ports", func(tx *gorm.DB) *gorm.DB { return tx.Order("protocol, port") }).
+		Preload("Ports.Scripts").Preload("Hops", func(tx *gorm.DB) *gorm.DB { return tx.Order("ttl") }).
+		Take(&v.Host, "IP = ?", ip).Error; err != nil {
+		return nil, err
+	}
+
+	var raw nmap.Host
+	if len(v.Host.Raw) > 0 {
+		json.Unmarshal(v.Host.Raw, &raw)
+	}
+	for _, h := range raw.Hostnames {
+		v.Hostnames = append(v.Hostnames, h.Name)
+	}
+	if len(v.Hostnames) == 0 && v.Host.Hostname != "" {
+		v.Hostnames = []string{v.Host.Hostname}
+	}
+	names, err := dnsNames(db, v.Host.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !slices.Contains(v.Hostnames, name) {
+			v.Hostnames = append(v.Hostnames, name)
+		}
+	}
+	for _, m := range raw.Os.OsMatches {
+		v.OS = append(v.OS, m.Name+" ("+m.Accuracy+"%)")
+	}
+	v.HostScripts = raw.HostScripts
+
+	scope, err := LoadScope(db)
+	if err != nil {
+		return nil, err
+	}
+	v.Scope = scope.Status(ip, v.Host.Hostname)
+
+	matcher := newExploitMatcher(db)
+	for _, port := range v.Host.Ports {
+		hp := HostPort{Port: port}
+		if hp.Cves, err = MatchCves(db, &port); err != nil {
+			return nil, err
+		}
+		if hp.Exploits, err = matcher.Match(&port); err != nil {
+			return nil, err
+		}
+		if err := db.Where("port_id = ?", port.ID).Order("url, method, status").Find(&hp.Endpoints).Error; err != nil {
+			return nil, err
+		}
+		if err := db.Where("port_id = ?", port.ID).Order("id DESC").Find(&hp.Screenshots).Error; err != nil {
+			return nil, err
+		}
+		v.Ports = append(v.Ports, hp)
+	}
+
+	if err := db.Where("ip = ?", ip).Order("port").Find(&v.Certs).Error; err != nil {
+		return nil, err
+	}
+	if v.Pages, err = pagesMentioning(append([]string{ip}, v.Hostnames...)); err != nil {
+		return nil, err
+	}
+	if v.Host.Router {
+		behind, err := hostsBehind(db, ip)
+		if err != nil {
+			return nil, err
+		}
+		v.Behind = len(behind)
+	}
+	if v.Prev, v.Next, err = hostNeighbours(db, ip); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func HostRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/host/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		t, err := template.New("host.html").Funcs(template.FuncMap{"severity": cvssSeverity, "status": statusBadge}).ParseFS(tpls, "templates/host.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v, err := BuildHostView(db, mux.Vars(r)["ip"])
+		if err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		if err := t.ExecuteTemplate(w, "page", TemplateRender{Title: v.Host.IP, Data: v}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+const (
+	jobLogSize = 64 * 1024
+	jobKeep    = 100
+)
+
+type Job struct {
+	ID        int
+	Kind      string
+	Name      string
+	State     string
+	Processed int
+	Total     int
+	Read      int64
+	Size      int64
+	Errors    []string
+	Created   time.Time
+	Started   time.Time
+	Finished  time.Time
+
+	mu     sync.Mutex
+	log    bytes.Buffer
+	out    io.Writer
+	cancel context.CancelFunc
+}
+
+type jobRegistry struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[int]*Job
+	// imports run one at a time, sqlite does not like concurrent writers
+	run sync.Mutex
+}
+
+var jobs = &jobRegistry{jobs: make(map[int]*Job)}
+
+// Write appends to the job log, and streams to the client of a synchronous
+// job.
+func (j *Job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.log.Write(p)
+	if j.log.Len() > jobLogSize {
+		keep := j.log.Bytes()[j.log.Len()-jobLogSize/2:]
+		j.log = *bytes.NewBuffer(append([]byte(nil), keep...))
+	}
+	if j.out != nil {
+		j.out.Write(p)
+		if f, ok := j.out.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return len(p), nil
+}
+
+func (j *Job) Errorf(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	j.mu.Lock()
+	j.Errors = append(j.Errors, msg)
+	j.mu.Unlock()
+	fmt.Fprintf(j, "ERROR %s \n", msg)
+}
+
+func (j *Job) Progress(processed, total int) {
+	j.mu.Lock()
+	j.Processed, j.Total = processed, total
+	j.mu.Unlock()
+}
+
+type jobReader struct {
+	r   io.Reader
+	job *Job
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	n, err := jr.r.Read(p)
+	jr.job.mu.Lock()
+	jr.job.Read += int64(n)
+	jr.job.mu.Unlock()
+	return n, err
+}
+
+// Reader counts the bytes the job reads from r, size is -1 when unknown.
+func (j *Job) Reader(r io.Reader, size int64) io.Reader {
+	j.mu.Lock()
+	j.Size = size
+	j.mu.Unlock()
+	return &jobReader{r: r, job: j}
+}
+
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.State != JobQueued && j.State != JobRunning {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+// Snapshot returns a copy safe to read while the job runs.
+func (j *Job) Snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID: j.ID, Kind: j.Kind, Name: j.Name, State: j.State,
+		Processed: j.Processed, Total: j.Total, Read: j.Read, Size: j.Size, Errors: append([]string(nil), j.Errors...),
+		Created: j.Created, Started: j.Started, Finished: j.Finished,
+	}
+}
+
+func (j *Job) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State == JobQueued || j.State == JobRunning
+}
+
+// Count returns processed/total, only processed while the total is unknown.
+func (j *Job) Count() string {
+	if j.Total == 0 && j.Processed > 0 {
+		return strconv.Itoa(j.Processed)
+	}
+	return fmt.Sprintf("%d/%d", j.Processed, j.Total)
+}
+
+func (j *Job) ReadProgress() string {
+	if j.Size <= 0 {
+		return fmt.Sprintf("%d bytes", j.Read)
+	}
+	return fmt.Sprintf("%d/%d bytes %d%%", j.Read, j.Size, j.Read*100/j.Size)
+}
+
+func (j *Job) Log() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.log.String()
+}
+
+func (j *Job) setState(state string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.State = state
+	switch state {
+	case JobRunning:
+		j.Started = time.Now()
+	case JobDone, JobFailed, JobCancelled:
+		j.Finished = time.Now()
+	}
+}
+
+// NewJob registers a job, out receives the log of a synchronous job and is
+// nil for a background one.
+func (reg *jobRegistry) NewJob(parent context.Context, kind, name string, out io.Writer) (*Job, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.nextID++
+	job := &Job{ID: reg.nextID, Kind: kind, Name: name, State: JobQueued, Created: time.Now(), out: out, cancel: cancel}
+	reg.jobs[job.ID] = job
+
+	if len(reg.jobs) > jobKeep {
+		for _, old := range reg.list() {
+			if len(reg.jobs) <= jobKeep {
+				break
+			}
+			if !old.running() {
+				delete(reg.jobs, old.ID)
+			}
+		}
+	}
+	return job, ctx
+}
+
+func (reg *jobRegistry) list() []*Job {
+	var res []*Job
+	for _, job := range reg.jobs {
+		res = append(res, job)
+	}
+	sort.Slice(res, func(i, k int) bool { return res[i].ID < res[k].ID })
+	return res
+}
+
+func (reg *jobRegistry) List() []*Job {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var res []*Job
+	for _, job := range reg.list() {
+		res = append(res, job.Snapshot())
+	}
+	return res
+}
+
+func (reg *jobRegistry) Get(id int) (*Job, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	job, ok := reg.jobs[id]
+	return job, ok
+}
+
+// Run waits for the previous imports then runs fn, the job state follows
+// its result.
+func (reg *jobRegistry) Run(ctx context.Context, job *Job, fn func(ctx context.Context, job *Job) error) error {
+	reg.run.Lock()
+	defer reg.run.Unlock()
+	defer job.cancel()
+
+	if ctx.Err() != nil {
+		job.setState(JobCancelled)
+		return ctx.Err()
+	}
+	job.setState(JobRunning)
+	err := fn(ctx, job)
+	switch {
+	case ctx.Err() != nil:
+		job.setState(JobCancelled)
+		fmt.Fprintf(job, "cancelled \n")
+		return ctx.Err()
+	case err != nil:
+		job.Errorf("%v", err)
+		job.setState(JobFailed)
+		return err
+	}
+	job.setState(JobDone)
+	return nil
+}
+
+// Start runs the job in background, cleanup runs once it is over even when
+// it was cancelled before starting.
+func (reg *jobRegistry) Start(ctx context.Context, job *Job, fn func(ctx context.Context, job *Job) error, cleanup func()) {
+	go func() {
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err := reg.Run(ctx, job, fn); err != nil {
+			log.Printf("job %d %s: %v", job.ID, job.Kind, err)
+		}
+	}()
+}
+
+func jobFromRequest(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return nil, false
+	}
+	job, ok := jobs.Get(id)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+func formatJob(job *Job) string {
+	res := fmt.Sprintf("id: %d\nkind: %s\nname: %s\nstate: %s\nprocessed: %s\n",
+		job.ID, job.Kind, job.Name, job.State, job.Count())
+	if job.Read > 0 {
+		res = res + fmt.Sprintf("read: %s\n", job.ReadProgress())
+	}
+	res = res + fmt.Sprintf("errors: %d\ncreated: %s\n", len(job.Errors), job.Created.Format(time.RFC3339))
+	if !job.Started.IsZero() {
+		res = res + fmt.Sprintf("started: %s\n", job.Started.Format(time.RFC3339))
+	}
+	if !job.Finished.IsZero() {
+		res = res + fmt.Sprintf("finished: %s\n", job.Finished.Format(time.RFC3339))
+	}
+	for _, e := range job.Errors {
+		res = res + fmt.Sprintf("error: %s\n", e)
+	}
+	return res
+}
+
+func JobsRouter(router *mux.Router) {
+
+	router.HandleFunc("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		job, ok := jobFromRequest(w, r)
+		if !ok {
+			return
+		}
+		w.Write([]byte(formatJob(job.Snapshot())))
+	}).Methods("GET")
+
+	router.HandleFunc("/jobs/{id}/log", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		job, ok := jobFromRequest(w, r)
+		if !ok {
+			return
+		}
+		w.Write([]byte(job.Log()))
+	}).Methods("GET")
+
+	router.HandleFunc("/jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] JOB CANCEL [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		job, ok := jobFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if !job.Cancel() {
+			http.Error(w, fmt.Sprintf("job %d already %s", job.ID, job.Snapshot().State), http.StatusConflict)
+			return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/jobs", http.StatusFound)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST", "DELETE")
+}
+
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Printf("[%s] JOBS VIEW [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+
+	list := jobs.List()
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		res := ""
+		for _, job := range list {
+			res = res + fmt.Sprintf("%d\t%s\t%s\t%s\terrors=%d\t%s\n", job.ID, job.Kind, job.State, job.Count(), len(job.Errors), job.Name)
+		}
+		w.Write([]byte(res))
+		return
+	}
+
+	t, err := template.ParseFS(tpls, "templates/base.html", "templates/jobs.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(list, func(i, k int) bool { return list[i].ID > list[k].ID })
+	tr := TemplateRender{Title: "jobs", Data: list, Sidebar: GenerateJsonNav()}
+
+	if err := t.ExecuteTemplate(w, "base", tr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func portKey(port uint, protocol string) string {
+	return fmt.Sprintf("%d/%s", port, protocol)
+}
+
+func deletePorts(db *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		del := tx.Unscoped().Session(&gorm.Session{SkipHooks: true})
+		if err := del.Where("port_id IN ?", ids).Delete(&Script{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&WebEndpoint{}).Where("port_id IN ?", ids).Update("port_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Screenshot{}).Where("port_id IN ?", ids).Update("port_id", nil).Error; err != nil {
+			return err
+		}
+		return del.Where("id IN ?", ids).Delete(&Port{}).Error
+	})
+}
+
+func deleteHost(db *gorm.DB, host *Host) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Model(&Port{}).Where("host_id = ?", host.ID).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if err := deletePorts(tx, ids); err != nil {
+			return err
+		}
+		del := tx.Unscoped().Session(&gorm.Session{SkipHooks: true})
+		if err := del.Where("host_id = ?", host.ID).Delete(&Script{}).Error; err != nil {
+			return err
+		}
+		if err := del.Where("host_id = ?", host.ID).Delete(&Hop{}).Error; err != nil {
+			return err
+		}
+		if err := del.Where("host_id = ?", host.ID).Delete(&ScanHost{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DnsRecord{}).Where("host_id = ?", host.ID).Update("host_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&WebEndpoint{}).Where("host_id = ?", host.ID).Update("host_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&AdObject{}).Where("host_id = ?", host.ID).Update("host_id", nil).Error; err != nil {
+			return err
+		}
+		return del.Delete(host).Error
+	})
+}
+
+// mergeHost prepares a forced re-import of existing, hostobj is then saved
+// over the same row: the scanned ports are replaced, manual ports the scan
+// did not see are kept and the operator notes and marks follow the port to
+// its new record.
+func mergeHost(db *gorm.DB, existing *Host, hostobj *Host) error {
+	hostobj.ID = existing.ID
+	hostobj.CreatedAt = existing.CreatedAt
+	hostobj.Manual = existing.Manual
+	hostobj.Status = existing.Status
+	hostobj.Assignee = existing.Assignee
+	hostobj.Router = existing.Router
+	hostobj.LastSeen = existing.LastSeen
+	if hostobj.Comment == "" {
+		hostobj.Comment = existing.Comment
+	}
+	if hostobj.Hostname == "" {
+		hostobj.Hostname = existing.Hostname
+	}
+
+	old := make(map[string]Port)
+	for _, port := range existing.Ports {
+		old[portKey(port.Port, port.Protocol)] = port
+	}
+	var replaced []uint
+	for i := range hostobj.Ports {
+		port := &hostobj.Ports[i]
+		prev, ok := old[portKey(port.Port, port.Protocol)]
+		if !ok {
+			continue
+		}
+		port.CreatedAt = prev.CreatedAt
+		port.Notes = prev.Notes
+		port.Tested = prev.Tested
+		port.Interesting = prev.Interesting
+		port.Status = prev.Status
+		port.Assignee = prev.Assignee
+		delete(old, portKey(port.Port, port.Protocol))
+		replaced = append(replaced, prev.ID)
+	}
+	for _, port := range old {
+		if !port.Manual {
+			replaced = append(replaced, port.ID)
+		}
+	}
+	if err := deletePorts(db, replaced); err != nil {
+		return err
+	}
+	tx := db.Unscoped().Session(&gorm.Session{SkipHooks: true})
+	if err := tx.Where("host_id = ?", existing.ID).Delete(&Hop{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("host_id = ?", existing.ID).Delete(&Script{}).Error
+}
+
+func formBool(r *http.Request, name string) bool {
+	v, _ := strconv.ParseBool(r.FormValue(name))
+	return v || r.FormValue(name) == "on"
+}
+
+var portStates = map[string]bool{
+	"open":            true,
+	"closed":          true,
+	"filtered":        true,
+	"unfiltered":      true,
+	"open|filtered":   true,
+	"closed|filtered": true,
+}
+
+func portFromForm(r *http.Request, port *Port) error {
+	if v := r.FormValue("port"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid port %q", v)
+		}
+		port.Port = uint(n)
+	}
+	if v := strings.ToLower(r.FormValue("proto")); v != "" {
+		if v != "tcp" && v != "udp" && v != "sctp" {
+			return fmt.Errorf("invalid protocol %q", v)
+		}
+		port.Protocol = v
+	}
+	if _, ok := r.Form["state"]; ok {
+		v := strings.ToLower(strings.TrimSpace(r.FormValue("state")))
+		if !portStates[v] {
+			return fmt.Errorf("invalid state %q", v)
+		}
+		port.State = v
+	}
+	for name, field := range map[string]*string{
+		"service": &port.Service,
+		"product": &port.Product,
+		"version": &port.Version,
+		"notes":   &port.Notes,
+	} {
+		if _, ok := r.Form[name]; ok {
+			*field = strings.TrimSpace(r.FormValue(name))
+		}
+	}
+	if _, ok := r.Form["tested"]; ok || r.FormValue("marks") != "" {
+		port.Tested = formBool(r, "tested")
+	}
+	if _, ok := r.Form["interesting"]; ok || r.FormValue("marks") != "" {
+		port.Interesting = formBool(r, "interesting")
+	}
+	return statusFromForm(r, &port.Status, &port.Assignee)
+}
+
+var errPortExists = errors.New("port already exists")
+
+// savePort runs save unless another port of the host already uses the same
+// port and protocol, which would hit the unique index.
+func savePort(db *gorm.DB, port *Port, save func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var n int64
+		err := tx.Model(&Port{}).Where("host_id = ? AND port = ? AND protocol = ? AND id <> ?", port.HostID, port.Port, port.Protocol, port.ID).Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errPortExists
+		}
+		return save(tx)
+	})
+}
+
+func portConflict(w http.ResponseWriter, err error, ip string, port *Port) bool {
+	if errors.Is(err, errPortExists) {
+		http.Error(w, fmt.Sprintf("%s:%s already exists", ip, portKey(port.Port, port.Protocol)), http.StatusConflict)
+		return true
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+func hostRedirect(w http.ResponseWriter, r *http.Request, ip string) bool {
+	if r.FormValue("redirect") == "" {
+		return false
+	}
+	http.Redirect(w, r, "/nmap/host/"+ip, http.StatusFound)
+	return true
+}
+
+func ManualRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] HOST ADD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		ip := strings.TrimSpace(r.FormValue("ip"))
+		if _, err := netip.ParseAddr(ip); err != nil {
+			http.Error(w, fmt.Sprintf("invalid ip %q", ip), http.StatusBadRequest)
+			return
+		}
+		host := &Host{IP: ip, Manual: true, Hostname: strings.TrimSpace(r.FormValue("hostname")), Comment: r.FormValue("comment")}
+		exists, err := host.Exists(db, ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			http.Error(w, fmt.Sprintf("%s already exists", ip), http.StatusConflict)
+			return
+		}
+		if err := db.Create(host).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := linkInventory(db); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hostRedirect(w, r, ip) {
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("adding %s \nOK\n", ip)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/host/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] HOST EDIT [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var host Host
+		if err := db.Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		r.ParseForm()
+		if _, ok := r.Form["hostname"]; ok {
+			host.Hostname = strings.TrimSpace(r.FormValue("hostname"))
+		}
+		if _, ok := r.Form["comment"]; ok {
+			host.Comment = r.FormValue("comment")
+		}
+		if err := statusFromForm(r, &host.Status, &host.Assignee); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.Model(&host).Select("hostname", "comment", "status", "assignee").Updates(&host).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hostRedirect(w, r, host.IP) {
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/host/{ip}/del", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] HOST DEL [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var host Host
+		if err := db.Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		if err := deleteHost(db, &host); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/nmap/dashboard", http.StatusFound)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST", "DELETE")
+
+	nmapRouter.HandleFunc("/host/{ip}/port", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] PORT ADD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var host Host
+		if err := db.Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		r.ParseForm()
+		port := &Port{HostID: host.ID, Protocol: "tcp", State: "open", Manual: true}
+		if err := portFromForm(r, port); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if port.Port == 0 {
+			http.Error(w, "missing port", http.StatusBadRequest)
+			return
+		}
+		err := savePort(db, port, func(tx *gorm.DB) error { return tx.Create(port).Error })
+		if portConflict(w, err, host.IP, port) {
+			return
+		}
+		if err := linkInventory(db); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hostRedirect(w, r, host.IP) {
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("adding %s:%d \nOK\n", host.IP, port.Port)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/host/{ip}/port/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] PORT EDIT [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var host Host
+		var port Port
+		if err := db.Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		if err := db.Take(&port, "id = ? AND host_id = ?", mux.Vars(r)["id"], host.ID).Error; err != nil {
+			dbError(w, err, "port")
+			return
+		}
+		r.ParseForm()
+		if err := portFromForm(r, &port); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := savePort(db, &port, func(tx *gorm.DB) error { return tx.Select("*").Omit("created_at").Updates(&port).Error })
+		if portConflict(w, err, host.IP, &port) {
+			return
+		}
+		if hostRedirect(w, r, host.IP) {
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/host/{ip}/port/{id}/del", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] PORT DEL [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var host Host
+		if err := db.Take(&host, "IP = ?", mux.Vars(r)["ip"]).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "port not found", http.StatusNotFound)
+			return
+		}
+		var n int64
+		if err := db.Model(&Port{}).Where("id = ? AND host_id = ?", id, host.ID).Count(&n).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "port not found", http.StatusNotFound)
+			return
+		}
+		if err := deletePorts(db, []uint{uint(id)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hostRedirect(w, r, host.IP) {
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST", "DELETE")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPortFromForm(t *testing.T) {
+	tests := []struct {
+		form    string
+		want    Port
+		wantErr bool
+	}{
+		{"port=3389&service=ms-wbt-server", Port{Port: 3389, Protocol: "tcp", State: "open", Service: "ms-wbt-server", Status: "untested"}, false},
+		{"port=53&proto=UDP&state=Open%7CFiltered", Port{Port: 53, Protocol: "udp", State: "open|filtered", Status: "untested"}, false},
+		{"notes=+through+pivot+&tested=on", Port{Protocol: "tcp", State: "open", Notes: "through pivot", Tested: true, Status: "untested"}, false},
+		{"marks=1&interesting=1", Port{Protocol: "tcp", State: "open", Interesting: true, Status: "untested"}, false},
+		{"status=Done&assignee=alice", Port{Protocol: "tcp", State: "open", Status: "done", Assignee: "alice"}, false},
+		{"port=0", Port{}, true},
+		{"port=65536", Port{}, true},
+		{"port=http", Port{}, true},
+		{"proto=icmp", Port{}, true},
+		{"state=%3Cscript%3Ealert(1)%3C%2Fscript%3E", Port{}, true},
+		{"state=", Port{}, true},
+		{"status=later", Port{}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/nmap/host/10.0.0.5/port", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		port := Port{Protocol: "tcp", State: "open", Status: "untested"}
+		err := portFromForm(r, &port)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("portFromForm(%q) accepted as %+v", tt.form, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("portFromForm(%q) %v", tt.form, err)
+			continue
+		}
+		if !reflect.DeepEqual(port, tt.want) {
+			t.Errorf("portFromForm(%q) = %+v, want %+v", tt.form, port, tt.want)
+		}
+	}
+}
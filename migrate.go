@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/gorm"
+)
+
+// SchemaMigration records the migrations applied to the database.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// migrations run in order before AutoMigrate, each one in a transaction,
+// new columns and tables are left to AutoMigrate.
+var migrations = []migration{
+	{1, "nmap host, port and script relations", migrateNmapRelations},
+}
+
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("unable to create schema_migrations %v", err)
+	}
+	var applied []int
+	if err := db.Model(&SchemaMigration{}).Pluck("version", &applied).Error; err != nil {
+		return err
+	}
+	done := make(map[int]bool)
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed %v", m.Version, m.Name, err)
+		}
+		log.Printf("applied migration %d (%s)", m.Version, m.Name)
+	}
+	return nil
+}
+
+func tableColumns(tx *gorm.DB, table string) (map[string]bool, error) {
+	types, err := tx.Migrator().ColumnTypes(table)
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]bool)
+	for _, t := range types {
+		cols[strings.ToLower(t.Name())] = true
+	}
+	return cols, nil
+}
+
+// copyTable copies the live rows of from into to, for the columns both
+// tables have, extra maps a column of to to an expression over from.
+func copyTable(tx *gorm.DB, from, to string, extra map[string]string, where string) error {
+	src, err := tableColumns(tx, from)
+	if err != nil {
+		return err
+	}
+	dst, err := tableColumns(tx, to)
+	if err != nil {
+		return err
+	}
+	var cols, exprs []string
+	for col := range dst {
+		if expr, ok := extra[col]; ok {
+			cols, exprs = append(cols, col), append(exprs, expr)
+		} else if src[col] {
+			cols, exprs = append(cols, col), append(exprs, col)
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE deleted_at IS NULL",
+		to, strings.Join(cols, ", "), strings.Join(exprs, ", "), from)
+	if where != "" {
+		query = query + " AND " + where
+	}
+	return tx.Exec(query).Error
+}
+
+// nmapRelationsV1 is the sqlite schema of hosts, ports and scripts as of
+// migration 1, frozen here so later model changes are left to AutoMigrate.
+var nmapRelationsV1 = []string{
+	"CREATE TABLE `hosts` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`ip` text,`hostname` text,`comment` text,`scan_id` integer,`manual` numeric,`status` text DEFAULT \"untested\",`assignee` text,`raw` JSON)",
+	"CREATE UNIQUE INDEX `idx_hosts_ip` ON `hosts`(`ip`)",
+	"CREATE INDEX `idx_hosts_deleted_at` ON `hosts`(`deleted_at`)",
+	"CREATE TABLE `ports` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`host_id` integer NOT NULL,`protocol` text,`port` integer,`state` text,`service` text,`product` text,`version` text,`extra` text,`tunnel` text,`cpe` text,`manual` numeric,`notes` text,`tested` numeric,`interesting` numeric,`status` text DEFAULT \"untested\",`assignee` text,CONSTRAINT `fk_hosts_ports` FOREIGN KEY (`host_id`) REFERENCES `hosts`(`id`) ON DELETE CASCADE)",
+	"CREATE INDEX `idx_ports_port` ON `ports`(`port`)",
+	"CREATE INDEX `idx_ports_deleted_at` ON `ports`(`deleted_at`)",
+	"CREATE TABLE `scripts` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`host_id` integer,`port_id` integer,`title` text,`output` text,`data` JSON,CONSTRAINT `fk_ports_scripts` FOREIGN KEY (`port_id`) REFERENCES `ports`(`id`) ON DELETE CASCADE,CONSTRAINT `fk_hosts_host_scripts` FOREIGN KEY (`host_id`) REFERENCES `hosts`(`id`) ON DELETE CASCADE)",
+	"CREATE INDEX `idx_scripts_host_id` ON `scripts`(`host_id`)",
+	"CREATE INDEX `idx_scripts_port_id` ON `scripts`(`port_id`)",
+	"CREATE INDEX `idx_scripts_title` ON `scripts`(`title`)",
+	"CREATE INDEX `idx_scripts_deleted_at` ON `scripts`(`deleted_at`)",
+}
+
+// migrateNmapRelations moves databases where ports.port_id pointed to the
+// host and scripts.script_id to either a port or a host to explicit
+// host_id/port_id columns. Duplicated ports keep their latest record, and
+// the owner of a script is resolved from the raw nmap output of the host.
+func migrateNmapRelations(tx *gorm.DB) error {
+	// databases of that schema only ever were sqlite files
+	if tx.Dialector.Name() != "sqlite" {
+		return nil
+	}
+	if !tx.Migrator().HasTable("ports") || !tx.Migrator().HasColumn("ports", "port_id") {
+		return nil
+	}
+
+	var tables []string
+	for _, table := range []string{"hosts", "ports", "scripts"} {
+		if !tx.Migrator().HasTable(table) {
+			continue
+		}
+		tables = append(tables, table)
+		var indexes []string
+		if err := tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).
+			Scan(&indexes).Error; err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			if err := tx.Exec(fmt.Sprintf("DROP INDEX `%s`", index)).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Migrator().RenameTable(table, table+"_v0"); err != nil {
+			return err
+		}
+	}
+	for _, ddl := range nmapRelationsV1 {
+		if err := tx.Exec(ddl).Error; err != nil {
+			return err
+		}
+	}
+
+	if tx.Migrator().HasTable("hosts_v0") {
+		if err := copyTable(tx, "hosts_v0", "hosts", nil, ""); err != nil {
+			return err
+		}
+	}
+	err := copyTable(tx, "ports_v0", "ports", map[string]string{"host_id": "port_id"},
+		"id IN (SELECT MAX(id) FROM ports_v0 WHERE deleted_at IS NULL GROUP BY port_id, protocol, port) AND port_id IN (SELECT id FROM hosts)")
+	if err != nil {
+		return err
+	}
+	if tx.Migrator().HasTable("scripts_v0") {
+		if err := copyTable(tx, "scripts_v0", "scripts", nil, ""); err != nil {
+			return err
+		}
+		if err := resolveScriptOwners(tx); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		if err := tx.Migrator().DropTable(table + "_v0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPortIndex adds the unique (host, protocol, port) index. It is not
+// declared on Port because the sqlite driver then reads each of the three
+// columns as unique and AutoMigrate rebuilds the table on every start, the
+// spaces keep its DDL parser from matching the column list.
+func createPortIndex(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&Port{}, "idx_ports_host_proto_port") {
+		return nil
+	}
+	return db.Exec("CREATE UNIQUE INDEX idx_ports_host_proto_port ON ports ( host_id, protocol, port )").Error
+}
+
+type legacyScript struct {
+	ID       uint
+	ScriptID string
+	Title    string
+	Output   string
+}
+
+// rawScripts indexes the scripts of a raw nmap host by port and title, port
+// "" holds the host scripts.
+func rawScripts(raw []byte) map[string]map[string]string {
+	var host nmap.Host
+	res := make(map[string]map[string]string)
+	if len(raw) == 0 || json.Unmarshal(raw, &host) != nil {
+		return res
+	}
+	add := func(key string, scripts []nmap.Script) {
+		res[key] = make(map[string]string)
+		for _, s := range scripts {
+			res[key][s.Id] = s.Output
+		}
+	}
+	for _, port := range host.Ports {
+		add(portKey(uint(port.PortId), port.Protocol), port.Scripts)
+	}
+	add("", host.HostScripts)
+	return res
+}
+
+// resolveScriptOwners points each copied script to the port or the host
+// its old script_id referred to, the owners of a batch are loaded at once.
+func resolveScriptOwners(tx *gorm.DB) error {
+	type portRef struct {
+		ID       uint
+		HostID   uint
+		Port     uint
+		Protocol string
+	}
+	type hostRef struct {
+		ID  uint
+		Raw []byte
+	}
+
+	var batch []legacyScript
+	toPort := make(map[uint][]uint)
+	toHost := make(map[uint][]uint)
+	res := tx.Table("scripts_v0").Select("id, script_id, title, output").
+		Where("deleted_at IS NULL").
+		FindInBatches(&batch, 500, func(btx *gorm.DB, _ int) error {
+			owners := make(map[uint]bool)
+			var ids []uint
+			for _, s := range batch {
+				if n, err := strconv.ParseUint(s.ScriptID, 10, 64); err == nil && !owners[uint(n)] {
+					owners[uint(n)] = true
+					ids = append(ids, uint(n))
+				}
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+
+			var portRows []portRef
+			if err := tx.Table("ports").Select("id, host_id, port, protocol").Where("id IN ?", ids).Scan(&portRows).Error; err != nil {
+				return err
+			}
+			ports := make(map[uint]portRef)
+			hostIDs := append([]uint{}, ids...)
+			for _, p := range portRows {
+				ports[p.ID] = p
+				if !owners[p.HostID] {
+					hostIDs = append(hostIDs, p.HostID)
+				}
+			}
+			var hostRows []hostRef
+			if err := tx.Table("hosts").Select("id, raw").Where("id IN ?", hostIDs).Scan(&hostRows).Error; err != nil {
+				return err
+			}
+			hosts := make(map[uint]map[string]map[string]string)
+			for _, h := range hostRows {
+				hosts[h.ID] = rawScripts(h.Raw)
+			}
+
+			for _, s := range batch {
+				n, err := strconv.ParseUint(s.ScriptID, 10, 64)
+				if err != nil {
+					continue
+				}
+				owner := uint(n)
+
+				port, portOK := ports[owner]
+				var portOut, hostOut string
+				var portHas, hostHas bool
+				if portOK {
+					if scripts, ok := hosts[port.HostID]; ok {
+						portOut, portHas = scripts[portKey(port.Port, port.Protocol)][s.Title]
+					}
+				}
+				scripts, hostOK := hosts[owner]
+				if hostOK {
+					hostOut, hostHas = scripts[""][s.Title]
+				}
+
+				switch {
+				case portHas && hostHas:
+					if hostOut == s.Output && portOut != s.Output {
+						toHost[owner] = append(toHost[owner], s.ID)
+					} else {
+						toPort[owner] = append(toPort[owner], s.ID)
+					}
+				case portHas:
+					toPort[owner] = append(toPort[owner], s.ID)
+				case hostHas:
+					toHost[owner] = append(toHost[owner], s.ID)
+				case portOK:
+					toPort[owner] = append(toPort[owner], s.ID)
+				case hostOK:
+					toHost[owner] = append(toHost[owner], s.ID)
+				}
+			}
+			return nil
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	for id, ids := range toPort {
+		if err := tx.Table("scripts").Where("id IN ?", ids).Update("port_id", id).Error; err != nil {
+			return err
+		}
+	}
+	for id, ids := range toHost {
+		if err := tx.Table("scripts").Where("id IN ?", ids).Update("host_id", id).Error; err != nil {
+			return err
+		}
+	}
+	// forced imports used to keep the scripts of the previous scan
+	return tx.Exec("DELETE FROM scripts WHERE (host_id IS NULL AND port_id IS NULL) OR id NOT IN (SELECT MAX(id) FROM scripts GROUP BY host_id, port_id, title)").Error
+}
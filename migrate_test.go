@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// the baseline schema, ports.port_id held the host and scripts.script_id
+// either a port or a host
+type v0Host struct {
+	gorm.Model
+	IP       string `gorm:"unique"`
+	Hostname string
+	Comment  string
+	Raw      datatypes.JSON
+}
+
+func (v0Host) TableName() string { return "hosts" }
+
+type v0Port struct {
+	gorm.Model
+	PortId   uint
+	Port     uint
+	Protocol string
+	State    string
+	Service  string
+}
+
+func (v0Port) TableName() string { return "ports" }
+
+type v0Script struct {
+	gorm.Model
+	Title    string
+	ScriptId string
+	Output   string
+}
+
+func (v0Script) TableName() string { return "scripts" }
+
+func TestMigrateNmapRelations(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "gorm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&v0Host{}, &v0Port{}, &v0Script{}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := json.Marshal(nmap.Host{
+		Ports: []nmap.Port{
+			{PortId: 443, Protocol: "tcp", Scripts: []nmap.Script{{Id: "ssl-cert", Output: "cert"}}},
+			{PortId: 22, Protocol: "tcp"},
+		},
+		HostScripts: []nmap.Script{{Id: "smb-os-discovery", Output: "windows"}},
+	})
+	host := v0Host{IP: "10.0.0.5", Hostname: "web.corp.local", Raw: raw}
+	if err := db.Create(&host).Error; err != nil {
+		t.Fatal(err)
+	}
+	// a forced import used to add the ports again, the latest one is kept
+	ports := []v0Port{
+		{PortId: host.ID, Port: 443, Protocol: "tcp", State: "open"},
+		{PortId: host.ID, Port: 443, Protocol: "tcp", State: "open", Service: "https"},
+		{PortId: host.ID, Port: 22, Protocol: "tcp", State: "open"},
+	}
+	if err := db.Create(&ports).Error; err != nil {
+		t.Fatal(err)
+	}
+	scripts := []v0Script{
+		{Title: "ssl-cert", ScriptId: "2", Output: "cert"},
+		{Title: "smb-os-discovery", ScriptId: "1", Output: "windows"},
+		{Title: "ssl-cert", ScriptId: "2", Output: "renewed cert"},
+	}
+	if err := db.Create(&scripts).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(Host{}, Port{}, Script{}, Hop{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createPortIndex(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var migrated []Port
+	if err := db.Order("port").Find(&migrated).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 2 {
+		t.Fatalf("got %d ports, want 2", len(migrated))
+	}
+	if migrated[1].ID != 2 || migrated[1].HostID != host.ID || migrated[1].Service != "https" {
+		t.Errorf("port 443 = %+v, want id 2 of host %d", migrated[1], host.ID)
+	}
+
+	var got []Script
+	if err := db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d scripts, want 2", len(got))
+	}
+	if got[0].Title != "smb-os-discovery" || got[0].HostID == nil || *got[0].HostID != host.ID || got[0].PortID != nil {
+		t.Errorf("host script = %+v, want host %d", got[0], host.ID)
+	}
+	if got[1].Title != "ssl-cert" || got[1].Output != "renewed cert" || got[1].PortID == nil || *got[1].PortID != 2 {
+		t.Errorf("port script = %+v, want port 2", got[1])
+	}
+
+	for _, table := range []string{"hosts_v0", "ports_v0", "scripts_v0"} {
+		if db.Migrator().HasTable(table) {
+			t.Errorf("%s left behind", table)
+		}
+	}
+	var versions []int
+	db.Model(&SchemaMigration{}).Pluck("version", &versions)
+	if len(versions) != 1 || versions[0] != 1 {
+		t.Errorf("applied migrations %v, want [1]", versions)
+	}
+	if err := Migrate(db); err != nil {
+		t.Errorf("second run %v", err)
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
-	"github.com/glebarez/sqlite"
 	"github.com/gorilla/mux"
 	"github.com/tomsteele/go-nmap"
 	"gorm.io/datatypes"
@@ -16,110 +23,399 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// Script is either a host script (HostID set) or the script of a port
+// (PortID set).
 type Script struct {
 	gorm.Model
-	ID       uint
-	Title    string
-	ScriptId string
-	Output   string
+	HostID *uint  `gorm:"index"`
+	PortID *uint  `gorm:"index"`
+	Title  string `gorm:"size:255;index"`
+	Output string
+	Data   datatypes.JSON
 }
 
 type Port struct {
 	gorm.Model
-	ID       uint
-	PortId   uint
-	Port     uint
-	Protocol string
-	State    string
-	Service  string
-	Scripts  []Script `gorm:"foreignKey:ScriptId;constraint:OnDelete:CASCADE"`
+	HostID      uint   `gorm:"not null"`
+	Protocol    string `gorm:"size:16"`
+	Port        uint   `gorm:"index"`
+	State       string
+	Service     string
+	Product     string
+	Version     string
+	Extra       string
+	Tunnel      string
+	CPE         string
+	Manual      bool
+	Notes       string
+	Tested      bool
+	Interesting bool
+	Status      string `gorm:"default:untested"`
+	Assignee    string
+	Scripts     []Script `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type Scan struct {
+	gorm.Model
+	Args  string
+	Start time.Time
+	Hosts int
+}
+
+// ScanHost records the hosts a scan saw, Host.ScanID only keeps the last
+// import that wrote the host.
+type ScanHost struct {
+	ScanID uint `gorm:"primaryKey;autoIncrement:false"`
+	HostID uint `gorm:"primaryKey;autoIncrement:false;index"`
+}
+
+// recordScanHosts links the hosts with the given ips to the scan and marks
+// them as seen, last_seen is only set here so manual edits do not change it.
+func recordScanHosts(db *gorm.DB, scanID uint, ips []string) error {
+	now := time.Now()
+	for len(ips) > 0 {
+		n := min(len(ips), 500)
+		if err := db.Model(&Host{}).Where("ip IN ?", ips[:n]).UpdateColumn("last_seen", now).Error; err != nil {
+			return err
+		}
+		var ids []uint
+		if err := db.Model(&Host{}).Where("ip IN ?", ips[:n]).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		var rows []ScanHost
+		for _, id := range ids {
+			rows = append(rows, ScanHost{ScanID: scanID, HostID: id})
+		}
+		if len(rows) > 0 {
+			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+				return err
+			}
+		}
+		ips = ips[n:]
+	}
+	return nil
+}
+
+// scanHosts selects the ids of the hosts seen by a scan.
+func scanHosts(db *gorm.DB, scanID uint) *gorm.DB {
+	return db.Model(&ScanHost{}).Select("host_id").Where("scan_id = ?", scanID)
 }
 
 type Host struct {
 	gorm.Model
-	ID          uint
-	IP          string `gorm:"unique;IP"`
+	IP          string `gorm:"size:64;uniqueIndex"`
+	IPKey       string `gorm:"size:33;index"`
 	Hostname    string
 	Comment     string
+	ScanID      uint
+	Manual      bool
+	Status      string `gorm:"default:untested"`
+	Assignee    string
+	Router      bool
+	LastSeen    *time.Time
 	Raw         datatypes.JSON
-	Ports       []Port   `gorm:"foreignKey:PortId;constraint:OnDelete:CASCADE"`
-	HostScripts []Script `gorm:"foreignKey:ScriptId;constraint:OnDelete:CASCADE"`
+	Ports       []Port   `gorm:"constraint:OnDelete:CASCADE"`
+	Hops        []Hop    `gorm:"constraint:OnDelete:CASCADE"`
+	HostScripts []Script `gorm:"foreignKey:HostID;constraint:OnDelete:CASCADE"`
 }
 
-func (h *Host) Exists(db *gorm.DB, ip string) bool {
-	var Exist bool
-	db.Raw("select exists(select 1 from hosts where IP= ? ) AS found;",
-		ip).Scan(&Exist)
-	return Exist
+func (h *Host) BeforeSave(tx *gorm.DB) error {
+	h.IPKey = ipSortKey(h.IP)
+	return nil
 }
 
-func (h *Host) AfterDelete(tx *gorm.DB) (err error) {
-	tx.Clauses(clause.Returning{}).Where("id = ?", h.ID).Delete(&Port{})
-	tx.Clauses(clause.Returning{}).Where("id = ?", h.ID).Delete(&Script{})
-	return
+// ipSortKey is the address family followed by the address in hex, sorting
+// the keys as strings sorts the addresses numerically with ipv4 first.
+func ipSortKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() {
+		return "4" + hex.EncodeToString(addr.AsSlice())
+	}
+	return "6" + hex.EncodeToString(addr.AsSlice())
 }
 
-func (h *Port) AfterDelete(tx *gorm.DB) (err error) {
-	tx.Clauses(clause.Returning{}).Where("id = ?", h.ID).Delete(&Script{})
-	return
+func (h *Host) Exists(db *gorm.DB, ip string) (bool, error) {
+	var Exist bool
+	err := db.Raw("select exists(select 1 from hosts where IP= ? ) AS found;",
+		ip).Scan(&Exist).Error
+	return Exist, err
 }
 
 func SetupGorm() error {
-	db, err := gorm.Open(sqlite.Open(config["gorm"]), &gorm.Config{})
+	db, err := openDatabase(config["db"])
 	if err != nil {
-		return fmt.Errorf("unable to connect database")
+		return err
 	}
 
-	db.AutoMigrate(Port{})
-	db.AutoMigrate(Script{})
-	db.AutoMigrate(Host{})
+	if err := Migrate(db); err != nil {
+		return err
+	}
 
+	seenColumn := db.Migrator().HasColumn(&Host{}, "last_seen")
+	err = db.AutoMigrate(Host{}, Port{}, Script{}, Scan{}, Cve{}, CveMatch{}, CpeProduct{}, Exploit{}, Cert{}, ScopeEntry{}, DnsRecord{}, WebEndpoint{}, Screenshot{}, AdObject{}, AdMember{}, AdSession{}, Hop{}, ScanHost{})
+	if err != nil {
+		return fmt.Errorf("unable to migrate database %v", err)
+	}
+
+	// imported hosts of older databases were last seen when last written
+	if !seenColumn {
+		if err := db.Exec("UPDATE hosts SET last_seen = updated_at WHERE raw IS NOT NULL").Error; err != nil {
+			return fmt.Errorf("unable to fill last_seen %v", err)
+		}
+	}
+
+	// hosts written before ip_key existed, or by raw sql, get their key
+	var unkeyed []Host
+	if err := db.Select("id, ip").Where("ip_key IS NULL OR ip_key = ''").Find(&unkeyed).Error; err != nil {
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, h := range unkeyed {
+			if err := tx.Model(&Host{}).Where("id = ?", h.ID).UpdateColumn("ip_key", ipSortKey(h.IP)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to fill ip_key %v", err)
+	}
+
+	// databases from before scan_hosts only know the last scan of a host
+	var recorded int64
+	if err := db.Model(&ScanHost{}).Count(&recorded).Error; err != nil {
+		return err
+	}
+	if recorded == 0 {
+		err := db.Exec("INSERT INTO scan_hosts (scan_id, host_id) SELECT scan_id, id FROM hosts WHERE scan_id <> 0 AND deleted_at IS NULL").Error
+		if err != nil {
+			return fmt.Errorf("unable to fill scan_hosts %v", err)
+		}
+	}
+
+	if err := createPortIndex(db); err != nil {
+		return fmt.Errorf("unable to index ports %v", err)
+	}
+
+	database = db
 	return nil
 }
 
-func parseNmap(w http.ResponseWriter, toparse []byte, update bool) error {
+// nmapStream reads the hosts of a nmap xml one at a time, only the current
+// host is held in memory.
+type nmapStream struct {
+	dec   *xml.Decoder
+	Args  string
+	Start time.Time
+}
 
-	db, err := gorm.Open(sqlite.Open(config["gorm"]), &gorm.Config{})
+func newNmapStream(r io.Reader) (*nmapStream, error) {
+	s := &nmapStream{dec: xml.NewDecoder(r)}
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse xml nmap")
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local != "nmaprun" {
+				return nil, fmt.Errorf("unable to parse xml nmap")
+			}
+			for _, attr := range se.Attr {
+				switch attr.Name.Local {
+				case "args":
+					s.Args = attr.Value
+				case "start":
+					if ts, err := strconv.ParseInt(attr.Value, 10, 64); err == nil {
+						s.Start = time.Unix(ts, 0)
+					}
+				}
+			}
+			return s, nil
+		}
+	}
+}
+
+// Next returns the next host, io.EOF once the scan is read.
+func (s *nmapStream) Next() (*nmap.Host, error) {
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "host" {
+			continue
+		}
+		host := &nmap.Host{}
+		if err := s.dec.DecodeElement(host, &se); err != nil {
+			return nil, err
+		}
+		return host, nil
+	}
+}
+
+// mergeDuplicateHost folds a second entry of the same ip in one xml, nmap
+// writes one per hostname, into the host waiting to be inserted.
+func mergeDuplicateHost(host *Host, dup *Host) {
+	if host.Hostname == "" {
+		host.Hostname = dup.Hostname
+	}
+	if len(host.Hops) == 0 {
+		host.Hops = dup.Hops
+	}
+	seen := make(map[string]bool)
+	for _, port := range host.Ports {
+		seen[portKey(port.Port, port.Protocol)] = true
+	}
+	for _, port := range dup.Ports {
+		if !seen[portKey(port.Port, port.Protocol)] {
+			host.Ports = append(host.Ports, port)
+		}
+	}
+	titles := make(map[string]bool)
+	for _, script := range host.HostScripts {
+		titles[script.Title] = true
+	}
+	for _, script := range dup.HostScripts {
+		if !titles[script.Title] {
+			host.HostScripts = append(host.HostScripts, script)
+		}
+	}
+}
+
+// resetHostIDs clears the keys a failed batch insert may have assigned.
+func resetHostIDs(host *Host) {
+	host.ID = 0
+	for i := range host.Ports {
+		host.Ports[i].ID = 0
+		host.Ports[i].HostID = 0
+		for j := range host.Ports[i].Scripts {
+			host.Ports[i].Scripts[j].ID = 0
+			host.Ports[i].Scripts[j].PortID = nil
+		}
+	}
+	for i := range host.HostScripts {
+		host.HostScripts[i].ID = 0
+		host.HostScripts[i].HostID = nil
+	}
+	for i := range host.Hops {
+		host.Hops[i].ID = 0
+		host.Hops[i].HostID = 0
+	}
+}
+
+func parseNmap(ctx context.Context, db *gorm.DB, job *Job, src io.Reader, update bool, rejectOutOfScope bool) error {
+
+	nn, err := newNmapStream(src)
 	if err != nil {
-		return fmt.Errorf("unable to connect database")
+		return err
 	}
 
-	nn, err := nmap.Parse(toparse)
+	filter, err := newScopeFilter(db, job, rejectOutOfScope)
 	if err != nil {
-		w.Write([]byte("unable to parse xml nmap\n"))
-		return fmt.Errorf("unable to parse xml nmap")
+		return err
+	}
+
+	scan := &Scan{Args: nn.Args, Start: time.Time(nn.Start)}
+	if err := db.Create(scan).Error; err != nil {
+		return fmt.Errorf("unable to record scan %v", err)
 	}
 	var batchInsert []Host
-	for _, host := range (*nn).Hosts {
+	var seen []string
+	pending := make(map[string]int)
+	created := 0
+	flush := func() {
+		if len(batchInsert) == 0 {
+			return
+		}
+		tx := db.Session(&gorm.Session{FullSaveAssociations: true})
+		if err := tx.Create(batchInsert).Error; err == nil {
+			created += len(batchInsert)
+		} else {
+			// one bad host fails the whole batch, retry them one by one so
+			// only that host is lost and named in the log
+			for i := range batchInsert {
+				h := &batchInsert[i]
+				resetHostIDs(h)
+				if err := tx.Create(h).Error; err != nil {
+					job.Errorf("unable to insert %s %v", h.IP, err)
+				} else {
+					created++
+				}
+			}
+		}
+		batchInsert = nil
+		clear(pending)
+	}
+	processed := 0
+	var parseErr error
+	for ctx.Err() == nil {
+		host, err := nn.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			parseErr = fmt.Errorf("unable to parse xml nmap %v", err)
+			break
+		}
+		processed++
+		job.Progress(processed, 0)
 
 		if host.Status.State == "up" {
 			if len(host.Addresses) != 0 {
 
 				hostobj := &Host{}
 				ip := host.Addresses[0].Addr
-				if hostobj.Exists(db, ip) {
-					fmt.Println("exists ", ip)
-					if !update {
+
+				hostname := ""
+				if len(host.Hostnames) != 0 {
+					hostname = host.Hostnames[0].Name
+				}
+				if !filter.Keep(ip, ip, hostname) {
+					continue
+				}
+				seen = append(seen, ip)
+
+				exists, err := hostobj.Exists(db, ip)
+				if err != nil {
+					parseErr = fmt.Errorf("unable to look up %s %v", ip, err)
+					break
+				}
+				var existing *Host
+				if exists {
+					router, err := routerOnly(db, ip)
+					if err != nil {
+						parseErr = fmt.Errorf("unable to look up %s %v", ip, err)
+						break
+					}
+					if !update && !router {
+						fmt.Fprintf(job, "skipping %s already imported \n", ip)
 						continue
-					} else {
-						db.Take(&hostobj, "IP = ?", ip)
-						db.Unscoped().Delete(&hostobj)
+					}
+					existing = &Host{}
+					if err := db.Preload("Ports").Take(existing, "IP = ?", ip).Error; err != nil {
+						parseErr = fmt.Errorf("unable to load %s %v", ip, err)
+						break
 					}
 				}
 
 				hostobj.IP = ip
 				hostobj.Comment = host.Comment
+				hostobj.ScanID = scan.ID
 
 				obj, err := json.Marshal(host)
 				if err != nil {
-					w.Write([]byte(fmt.Sprintf("unable to marshall host %s \n", ip)))
+					job.Errorf("unable to marshall host %s", ip)
 				} else {
 					hostobj.Raw = obj
 				}
 
-				if len(host.Hostnames) != 0 {
-					hostobj.Hostname = host.Hostnames[0].Name
-				}
+				hostobj.Hostname = hostname
+				hostobj.Hops = traceHops(host.Trace)
 
 				for _, port := range host.Ports {
 					portobj := &Port{}
@@ -127,13 +423,23 @@ func parseNmap(w http.ResponseWriter, toparse []byte, update bool) error {
 					portobj.Protocol = port.Protocol
 					portobj.State = port.State.State
 					portobj.Service = port.Service.Name
+					portobj.Product = port.Service.Product
+					portobj.Version = port.Service.Version
+					portobj.Extra = port.Service.ExtraInfo
+					portobj.Tunnel = port.Service.Tunnel
+					var cpes []string
+					for _, cpe := range port.Service.CPEs {
+						cpes = append(cpes, string(cpe))
+					}
+					portobj.CPE = strings.Join(cpes, " ")
 
-					w.Write([]byte(fmt.Sprintf("adding %s:%d \n", hostobj.IP, portobj.Port)))
+					fmt.Fprintf(job, "adding %s:%d \n", hostobj.IP, portobj.Port)
 
 					for _, script := range port.Scripts {
 						scriptobj := &Script{}
 						scriptobj.Title = script.Id
 						scriptobj.Output = script.Output
+						scriptobj.Data = scriptData(script)
 						portobj.Scripts = append(portobj.Scripts, *scriptobj)
 					}
 					hostobj.Ports = append(hostobj.Ports, *portobj)
@@ -142,54 +448,122 @@ func parseNmap(w http.ResponseWriter, toparse []byte, update bool) error {
 					scriptobj := &Script{}
 					scriptobj.Title = script.Id
 					scriptobj.Output = script.Output
+					scriptobj.Data = scriptData(script)
 					hostobj.HostScripts = append(hostobj.HostScripts, *scriptobj)
 				}
+				if existing != nil {
+					err := db.Transaction(func(tx *gorm.DB) error {
+						if err := mergeHost(tx, existing, hostobj); err != nil {
+							return err
+						}
+						return tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(hostobj).Error
+					})
+					if err != nil {
+						job.Errorf("unable to update %s %v", ip, err)
+					} else {
+						created++
+					}
+					continue
+				}
+				if i, ok := pending[ip]; ok {
+					fmt.Fprintf(job, "merging duplicate %s \n", ip)
+					mergeDuplicateHost(&batchInsert[i], hostobj)
+					continue
+				}
+				pending[ip] = len(batchInsert)
 				batchInsert = append(batchInsert, *hostobj)
+				if len(batchInsert) >= 100 {
+					flush()
+				}
 			}
 		}
 	}
-	if len(batchInsert) > 0 {
-		db.Session(&gorm.Session{FullSaveAssociations: true}).Create(batchInsert)
-		//db.Create(batchInsert)
+	flush()
+	if ctx.Err() == nil && parseErr == nil {
+		job.Progress(processed, processed)
 	}
-	return nil
+	if err := db.Model(scan).Update("hosts", created).Error; err != nil {
+		job.Errorf("unable to update scan %v", err)
+	}
+	if err := recordScanHosts(db, scan.ID, seen); err != nil {
+		job.Errorf("unable to record the hosts of the scan %v", err)
+	}
+	if created > 0 {
+		if _, err := syncNmapCerts(db); err != nil {
+			job.Errorf("unable to update certificate inventory %v", err)
+		}
+		if n, err := markRouters(db, filter, scan.ID); err != nil {
+			job.Errorf("unable to mark routers %v", err)
+		} else if n > 0 {
+			fmt.Fprintf(job, "added %d routers seen in traceroutes \n", n)
+		}
+		if err := linkInventory(db); err != nil {
+			job.Errorf("unable to link dns records, web endpoints and screenshots %v", err)
+		}
+	}
+	return parseErr
 }
 
 func NmapRouter() http.Handler {
 
 	nmapRouter := mux.NewRouter()
-
-	db, err := gorm.Open(sqlite.Open(config["gorm"]), &gorm.Config{})
-	if err != nil {
-		log.Printf("unable to connect database %v", err)
-	}
+	db := database
 
 	nmapRouter.HandleFunc("/up", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[%s] NMAP UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
-		content, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		reject := r.URL.Query().Get("scope") == "reject"
+		update := r.URL.Query().Get("force") != ""
+
+		if r.URL.Query().Get("async") == "" {
+			// the log streams while the body is still being read
+			http.NewResponseController(w).EnableFullDuplex()
+			job, ctx := jobs.NewJob(r.Context(), "nmap", r.RemoteAddr, w)
+			err := jobs.Run(ctx, job, func(ctx context.Context, job *Job) error {
+				return parseNmap(ctx, db, job, job.Reader(r.Body, r.ContentLength), update, reject)
+			})
+			if err != nil {
+				w.Write([]byte("NOK\n"))
+			} else {
+				w.Write([]byte("OK\n"))
+			}
 			return
 		}
 
-		if r.URL.Query().Get("force") != "" {
-			err = parseNmap(w, content, true)
-		} else {
-			err = parseNmap(w, content, false)
+		// the body is spooled to disk so the request can return before
+		// the import runs
+		spool, err := os.CreateTemp("", "wikix-nmap-*.xml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
+		size, err := io.Copy(spool, r.Body)
+		spool.Close()
 		if err != nil {
-			w.Write([]byte("NOK\n"))
-		} else {
-			w.Write([]byte("OK\n"))
+			os.Remove(spool.Name())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		job, ctx := jobs.NewJob(context.Background(), "nmap", fmt.Sprintf("%s %d bytes", r.RemoteAddr, size), nil)
+		jobs.Start(ctx, job, func(ctx context.Context, job *Job) error {
+			f, err := os.Open(spool.Name())
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return parseNmap(ctx, db, job, job.Reader(f, size), update, reject)
+		}, func() { os.Remove(spool.Name()) })
+		w.Write([]byte(fmt.Sprintf("job %d /jobs/%d \nOK\n", job.ID, job.ID)))
+
 	}).Methods("POST")
 
 	nmapRouter.HandleFunc("/show/{ip}/all", func(w http.ResponseWriter, r *http.Request) {
 		ip := mux.Vars(r)["ip"]
 		var host Host
-		db.Preload("Ports").Preload("Ports.Scripts").Preload("HostScripts").Take(&host, "IP = ?", ip)
+		if err := db.Preload("Ports").Preload("Ports.Scripts").Preload("HostScripts").Take(&host, "IP = ?", ip).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
 		res, _ := json.MarshalIndent(host, "", "  ")
 		w.Write(res)
 	}).Methods("GET")
@@ -198,7 +572,10 @@ func NmapRouter() http.Handler {
 		ip := mux.Vars(r)["ip"]
 		var host Host
 		res := ""
-		db.Preload("Ports").Take(&host, "IP = ?", ip)
+		if err := db.Preload("Ports").Take(&host, "IP = ?", ip).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
 		for _, port := range host.Ports {
 			res = res + fmt.Sprintf("%d\n", port.Port)
 		}
@@ -210,24 +587,66 @@ func NmapRouter() http.Handler {
 		ip := mux.Vars(r)["ip"]
 		var host Host
 		res := ""
-		db.Preload("Ports").Preload("Ports.Scripts").Take(&host, "IP = ?", ip)
+		if err := db.Preload("Ports").Preload("Ports.Scripts").Take(&host, "IP = ?", ip).Error; err != nil {
+			dbError(w, err, "host")
+			return
+		}
+		matcher := newExploitMatcher(db)
 		for _, port := range host.Ports {
 			res = res + fmt.Sprintf("%d:\n", port.Port)
 			for _, script := range port.Scripts {
 				res = res + fmt.Sprintf("\t%s:\n\t\t%s\n", script.Title, script.Output)
 			}
+			cves, _ := MatchCves(db, &port)
+			if len(cves) > 0 {
+				res = res + "\tcves:\n"
+				for _, c := range cves {
+					res = res + fmt.Sprintf("\t\t%s\n", formatCve(c))
+				}
+			}
+			exploits, _ := matcher.Match(&port)
+			if len(exploits) > 0 {
+				res = res + "\texploits:\n"
+				for _, e := range exploits {
+					res = res + fmt.Sprintf("\t\t%s\n", formatExploit(e))
+				}
+			}
 			res = res + "---------------------------\n"
 		}
 		w.Write([]byte(res))
 
 	}).Methods("GET")
 
+	CveRouter(nmapRouter, db)
+	ExploitRouter(nmapRouter, db)
+	NseRouter(nmapRouter, db)
+	CertRouter(nmapRouter, db)
+	QueryRouter(nmapRouter, db)
+	ExportRouter(nmapRouter, db)
+	NmapXmlRouter(nmapRouter, db)
+	DnsRouter(nmapRouter, db)
+	WebRouter(nmapRouter, db)
+	ScreenshotRouter(nmapRouter, db)
+	AdRouter(nmapRouter, db)
+	GraphRouter(nmapRouter, db)
+	HopRouter(nmapRouter, db)
+	ScopeRouter(nmapRouter, db)
+
 	nmapRouter.HandleFunc("/ports/{port}", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("Content-encoding", "utf-8")
-		port := mux.Vars(r)["port"]
+		port, err := strconv.ParseUint(mux.Vars(r)["port"], 10, 16)
+		if err != nil {
+			http.Error(w, "invalid port", http.StatusBadRequest)
+			return
+		}
 		var hosts []string
-		db.Raw("select hosts.IP from ports,hosts where port=? and ports.port_id = hosts.id;", port).Find(&hosts)
+		err = db.Model(&Port{}).Joins("JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL").
+			Where("ports.port = ?", port).Order("hosts.ip").Pluck("hosts.ip", &hosts).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		res := ""
 		for _, host := range hosts {
 			res = res + fmt.Sprintf("%s\n", host)
@@ -239,23 +658,44 @@ func NmapRouter() http.Handler {
 	nmapRouter.HandleFunc("/ips", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("Content-encoding", "utf-8")
+		cidrs, err := parseCidrs(r.URL.Query().Get("cidr"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := &NmapQuery{Cidrs: cidrs}
 		var hosts []string
-		db.Raw("select hosts.IP from hosts").Find(&hosts)
+		if err := db.Model(&Host{}).Pluck("ip", &hosts).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		res := ""
 		for _, host := range hosts {
-			res = res + fmt.Sprintf("%s\n", host)
+			if q.matchHost(host, "") {
+				res = res + fmt.Sprintf("%s\n", host)
+			}
 		}
 		w.Write([]byte(res))
 	}).Methods("GET")
 
+	SubnetRouter(nmapRouter, db)
+	WorkflowRouter(nmapRouter, db)
+	DashboardRouter(nmapRouter, db)
+	HostRouter(nmapRouter, db)
+	ManualRouter(nmapRouter, db)
+
 	return nmapRouter
 }
 
-func GenerateSidebarNmap(ips []string) string {
+func GenerateSidebarNmap(subnets []*Subnet, scope *Scope) string {
 	var toJson []*BS5TreeE
-	for _, ip := range ips {
-		n := &BS5TreeE{Text: ip, Icon: "fa fa-file-text-o", Class: "ipaddr", ID: ip}
-		toJson = append(toJson, n)
+	for _, subnet := range subnets {
+		node := &BS5TreeE{Icon: "fa fa-sitemap", Class: "subnet", ID: subnet.Prefix.String()}
+		node.Text = fmt.Sprintf(`%s <span class="badge bg-secondary">%d</span> <span class="badge bg-info">%d</span>`,
+			subnet.Prefix, len(subnet.Hosts), subnet.Open)
+		node.Expanded = len(subnets) == 1
+		node.Nodes = sidebarHosts(subnet.Hosts, scope)
+		toJson = append(toJson, node)
 	}
 
 	jsonA, _ := json.MarshalIndent(toJson, "", "  ")
@@ -263,14 +703,34 @@ func GenerateSidebarNmap(ips []string) string {
 	return string(jsonA)
 }
 
+func sidebarHosts(hosts []subnetHost, scope *Scope) []*BS5TreeE {
+	var nodes []*BS5TreeE
+	for _, host := range hosts {
+		n := &BS5TreeE{Text: host.IP, Icon: "fa fa-file-text-o", Class: "ipaddr", ID: host.IP}
+		switch scope.Status(host.IP, host.Hostname) {
+		case ScopeOut:
+			n.Icon = "fa fa-ban text-danger"
+			n.Text = host.IP + ` <span class="badge bg-danger">out</span>`
+		case ScopeExcluded:
+			n.Icon = "fa fa-ban text-danger"
+			n.Text = host.IP + ` <span class="badge bg-secondary">excluded</span>`
+		case ScopeIn:
+			n.Icon = "fa fa-check text-success"
+		}
+		if host.Router {
+			n.Text = n.Text + ` <span class="badge bg-primary" title="seen as a traceroute hop">router</span>`
+		}
+		n.Text = n.Text + " " + statusBadge(host.Status, host.Assignee)
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
 func NmapHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[%s] NMAP VIEW [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
 
-	db, err := gorm.Open(sqlite.Open(config["gorm"]), &gorm.Config{})
-	if err != nil {
-		log.Printf("unable to connect database %v", err)
-	}
+	db := database
 	t, err := template.ParseFS(tpls, "templates/base.html", "templates/nmap.html")
 
 	if err != nil {
@@ -278,16 +738,26 @@ func NmapHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var hosts []Host
+	bits, err := parsePrefixLen(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db.Select("IP").Find(&hosts)
+	hosts, err := subnetHosts(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	var ips []string
-	for _, host := range hosts {
-		ips = append(ips, host.IP)
+	scope, err := LoadScope(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	tr := TemplateRender{Title: "nmap", Sidebar: GenerateSidebarNmap(ips)}
+	prefixes := []string{"8", "16", "24", "28", "32"}
+	tr := TemplateRender{Title: "nmap", Data: prefixes, Content: strconv.Itoa(bits), Sidebar: GenerateSidebarNmap(GroupSubnets(hosts, bits), scope)}
 
 	if err := t.ExecuteTemplate(w, "base", tr); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/gorm"
+)
+
+// the nmaprun elements written by the export, unlike the go-nmap types
+// empty attributes and sections are left out
+type xmlHost struct {
+	StartTime int64          `xml:"starttime,attr,omitempty"`
+	EndTime   int64          `xml:"endtime,attr,omitempty"`
+	Comment   string         `xml:"comment,attr,omitempty"`
+	Status    xmlState       `xml:"status"`
+	Addresses []xmlAddress   `xml:"address"`
+	Hostnames *xmlHostnames  `xml:"hostnames"`
+	Ports     *xmlPorts      `xml:"ports"`
+	Os        *xmlOs         `xml:"os,omitempty"`
+	Uptime    *xmlUptime     `xml:"uptime,omitempty"`
+	Distance  *xmlDistance   `xml:"distance,omitempty"`
+	Scripts   *xmlHostScript `xml:"hostscript"`
+	Trace     *xmlTrace      `xml:"trace,omitempty"`
+}
+
+// the wrappers are pointers so encoding/xml leaves out the empty ones
+type xmlHostnames struct {
+	Hostnames []xmlHostname `xml:"hostname"`
+}
+
+type xmlPorts struct {
+	Ports []xmlPort `xml:"port"`
+}
+
+type xmlHostScript struct {
+	Scripts []xmlScript `xml:"script"`
+}
+
+type xmlState struct {
+	State     string  `xml:"state,attr"`
+	Reason    string  `xml:"reason,attr"`
+	ReasonTTL float32 `xml:"reason_ttl,attr"`
+}
+
+type xmlAddress struct {
+	Addr     string `xml:"addr,attr"`
+	AddrType string `xml:"addrtype,attr"`
+	Vendor   string `xml:"vendor,attr,omitempty"`
+}
+
+type xmlHostname struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type xmlPort struct {
+	Protocol string      `xml:"protocol,attr"`
+	PortId   uint        `xml:"portid,attr"`
+	State    xmlState    `xml:"state"`
+	Service  *xmlService `xml:"service,omitempty"`
+	Scripts  []xmlScript `xml:"script"`
+}
+
+type xmlService struct {
+	Name      string   `xml:"name,attr"`
+	Product   string   `xml:"product,attr,omitempty"`
+	Version   string   `xml:"version,attr,omitempty"`
+	ExtraInfo string   `xml:"extrainfo,attr,omitempty"`
+	Tunnel    string   `xml:"tunnel,attr,omitempty"`
+	Method    string   `xml:"method,attr"`
+	Conf      int      `xml:"conf,attr"`
+	CPEs      []string `xml:"cpe"`
+}
+
+type xmlScript struct {
+	Id       string     `xml:"id,attr"`
+	Output   string     `xml:"output,attr"`
+	Tables   []xmlTable `xml:"table"`
+	Elements []xmlElem  `xml:"elem"`
+}
+
+type xmlTable struct {
+	Key      string     `xml:"key,attr,omitempty"`
+	Tables   []xmlTable `xml:"table"`
+	Elements []xmlElem  `xml:"elem"`
+}
+
+type xmlElem struct {
+	Key   string `xml:"key,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type xmlOs struct {
+	Matches []xmlOsMatch `xml:"osmatch"`
+}
+
+type xmlOsMatch struct {
+	Name     string `xml:"name,attr"`
+	Accuracy string `xml:"accuracy,attr"`
+	Line     string `xml:"line,attr,omitempty"`
+}
+
+type xmlUptime struct {
+	Seconds  int    `xml:"seconds,attr"`
+	Lastboot string `xml:"lastboot,attr,omitempty"`
+}
+
+type xmlDistance struct {
+	Value int `xml:"value,attr"`
+}
+
+type xmlTrace struct {
+	Port  int      `xml:"port,attr,omitempty"`
+	Proto string   `xml:"proto,attr,omitempty"`
+	Hops  []xmlHop `xml:"hop"`
+}
+
+type xmlHop struct {
+	TTL    int    `xml:"ttl,attr"`
+	IPAddr string `xml:"ipaddr,attr"`
+	RTT    string `xml:"rtt,attr,omitempty"`
+	Host   string `xml:"host,attr,omitempty"`
+}
+
+func xmlTables(tables []nmap.Table) []xmlTable {
+	var res []xmlTable
+	for _, t := range tables {
+		res = append(res, xmlTable{Key: t.Key, Tables: xmlTables(t.Table), Elements: xmlElems(t.Elements)})
+	}
+	return res
+}
+
+func xmlElems(elems []nmap.Element) []xmlElem {
+	var res []xmlElem
+	for _, e := range elems {
+		res = append(res, xmlElem{Key: e.Key, Value: e.Value})
+	}
+	return res
+}
+
+// xmlScripts writes the scripts stored for a port or host, the structured
+// output is taken from the raw scan when it still has the same script.
+func xmlScripts(scripts []Script, raw []nmap.Script) []xmlScript {
+	var res []xmlScript
+	for _, s := range scripts {
+		x := xmlScript{Id: s.Title, Output: s.Output}
+		for _, r := range raw {
+			if r.Id == s.Title && r.Output == s.Output {
+				x.Tables, x.Elements = xmlTables(r.Tables), xmlElems(r.Elements)
+				break
+			}
+		}
+		res = append(res, x)
+	}
+	return res
+}
+
+// nmapHost rebuilds the nmap host of h. Ports, scripts and hops are the
+// current records, the raw scan output only fills in what the database
+// does not keep: addresses, os guesses, uptime and service detection.
+func nmapHost(h *Host, start time.Time) xmlHost {
+	var raw nmap.Host
+	if len(h.Raw) > 0 {
+		json.Unmarshal(h.Raw, &raw)
+	}
+
+	host := xmlHost{
+		StartTime: time.Time(raw.StartTime).Unix(),
+		EndTime:   time.Time(raw.EndTime).Unix(),
+		Comment:   h.Comment,
+		Status:    xmlState{State: raw.Status.State, Reason: raw.Status.Reason, ReasonTTL: raw.Status.ReasonTTL},
+	}
+	if time.Time(raw.StartTime).IsZero() {
+		host.StartTime = start.Unix()
+	}
+	if time.Time(raw.EndTime).IsZero() {
+		host.EndTime = host.StartTime
+	}
+	if host.Status.State == "" {
+		host.Status = xmlState{State: "up", Reason: "user-set"}
+	}
+
+	for _, a := range raw.Addresses {
+		host.Addresses = append(host.Addresses, xmlAddress{Addr: a.Addr, AddrType: a.AddrType, Vendor: a.Vendor})
+	}
+	if len(host.Addresses) == 0 {
+		host.Addresses = []xmlAddress{{Addr: h.IP, AddrType: addrType(h.IP)}}
+	}
+	var names []xmlHostname
+	for _, n := range raw.Hostnames {
+		names = append(names, xmlHostname{Name: n.Name, Type: n.Type})
+	}
+	if len(names) == 0 && h.Hostname != "" {
+		names = []xmlHostname{{Name: h.Hostname, Type: "user"}}
+	}
+	if len(names) > 0 {
+		host.Hostnames = &xmlHostnames{names}
+	}
+
+	rawPorts := make(map[string]nmap.Port)
+	for _, p := range raw.Ports {
+		rawPorts[portKey(uint(p.PortId), p.Protocol)] = p
+	}
+	var ports []xmlPort
+	for _, port := range h.Ports {
+		rp, scanned := rawPorts[portKey(port.Port, port.Protocol)]
+		p := xmlPort{
+			Protocol: port.Protocol,
+			PortId:   port.Port,
+			State:    xmlState{State: port.State, Reason: "user-set"},
+			Scripts:  xmlScripts(port.Scripts, rp.Scripts),
+		}
+		if scanned && rp.State.State == port.State {
+			p.State = xmlState{State: rp.State.State, Reason: rp.State.Reason, ReasonTTL: rp.State.ReasonTTL}
+		}
+		if port.Service != "" || port.Product != "" {
+			svc := &xmlService{
+				Name:      port.Service,
+				Product:   port.Product,
+				Version:   port.Version,
+				ExtraInfo: port.Extra,
+				Tunnel:    port.Tunnel,
+				Method:    "table",
+				Conf:      3,
+				CPEs:      strings.Fields(port.CPE),
+			}
+			if scanned && rp.Service.Name == port.Service && rp.Service.Method != "" {
+				svc.Method, svc.Conf = rp.Service.Method, rp.Service.Conf
+			}
+			p.Service = svc
+		}
+		ports = append(ports, p)
+	}
+	if len(ports) > 0 {
+		host.Ports = &xmlPorts{ports}
+	}
+
+	if len(raw.Os.OsMatches) > 0 {
+		host.Os = &xmlOs{}
+		for _, m := range raw.Os.OsMatches {
+			host.Os.Matches = append(host.Os.Matches, xmlOsMatch{Name: m.Name, Accuracy: m.Accuracy, Line: m.Line})
+		}
+	}
+	if raw.Uptime.Seconds > 0 {
+		host.Uptime = &xmlUptime{Seconds: raw.Uptime.Seconds, Lastboot: raw.Uptime.Lastboot}
+	}
+	if raw.Distance.Value > 0 {
+		host.Distance = &xmlDistance{Value: raw.Distance.Value}
+	}
+	if len(h.HostScripts) > 0 {
+		host.Scripts = &xmlHostScript{xmlScripts(h.HostScripts, raw.HostScripts)}
+	}
+	if len(h.Hops) > 0 {
+		host.Trace = &xmlTrace{Port: raw.Trace.Port, Proto: raw.Trace.Proto}
+		for _, hop := range h.Hops {
+			host.Trace.Hops = append(host.Trace.Hops, xmlHop{TTL: hop.TTL, IPAddr: hop.IP, RTT: strconv.FormatFloat(hop.RTT, 'f', 2, 64), Host: hop.Name})
+		}
+	}
+	return host
+}
+
+func addrType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// writeNmapXml streams the hosts as an nmaprun document, hosts are loaded
+// by batches so a whole database can be exported.
+func writeNmapXml(w io.Writer, db *gorm.DB, scan *Scan, q *NmapQuery) error {
+	start := time.Now()
+	args := "wikix export"
+	if scan != nil {
+		start, args = scan.Start, scan.Args
+	}
+	io.WriteString(w, xml.Header+"<!DOCTYPE nmaprun>\n")
+	io.WriteString(w, fmt.Sprintf("<nmaprun scanner=\"nmap\" args=\"%s\" start=\"%d\" startstr=\"%s\" xmloutputversion=\"1.05\">\n",
+		xmlAttr(args), start.Unix(), start.Format(time.ANSIC)))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	tx := db.Preload("Ports", func(db *gorm.DB) *gorm.DB { return db.Order("protocol, port") }).
+		Preload("Ports.Scripts").Preload("HostScripts").
+		Preload("Hops", func(db *gorm.DB) *gorm.DB { return db.Order("ttl") }).Order("id")
+	if scan != nil {
+		tx = tx.Where("id IN (?)", scanHosts(db, scan.ID))
+	}
+	up := 0
+	var batch []Host
+	res := tx.FindInBatches(&batch, 200, func(_ *gorm.DB, _ int) error {
+		for i := range batch {
+			if !q.matchHost(batch[i].IP, batch[i].Hostname) {
+				continue
+			}
+			if err := enc.EncodeElement(nmapHost(&batch[i], start), xml.StartElement{Name: xml.Name{Local: "host"}}); err != nil {
+				return err
+			}
+			up++
+		}
+		return enc.Flush()
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	end := time.Now()
+	io.WriteString(w, fmt.Sprintf("\n<runstats><finished time=\"%d\" timestr=\"%s\" summary=\"%d IP addresses (%d hosts up)\" exit=\"success\"/><hosts up=\"%d\" down=\"0\" total=\"%d\"/></runstats>\n</nmaprun>\n",
+		end.Unix(), end.Format(time.ANSIC), up, up, up, up))
+	return nil
+}
+
+func xmlAttr(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func NmapXmlRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/xml", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] NMAP XML [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		cidrs, err := parseCidrs(r.URL.Query().Get("ips"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var scan *Scan
+		if s := r.URL.Query().Get("scan"); s != "" {
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid scan", http.StatusBadRequest)
+				return
+			}
+			scan = &Scan{}
+			if err := db.Take(scan, id).Error; err != nil {
+				dbError(w, err, "scan")
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		name := "wikix"
+		if scan != nil {
+			name = fmt.Sprintf("wikix-scan-%d", scan.ID)
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".xml"))
+		if err := writeNmapXml(w, db, scan, &NmapQuery{Cidrs: cidrs}); err != nil {
+			// headers are gone, the truncated document tells the client
+			log.Printf("[%s] NMAP XML failed : %v \n", r.RemoteAddr, err)
+		}
+	}).Methods("GET")
+}
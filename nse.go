@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/tomsteele/go-nmap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type scriptRef struct {
+	IP     string
+	Port   uint
+	Script Script
+}
+
+type scriptLeaf struct {
+	Path  string
+	Value string
+}
+
+// nseValue turns nse <elem>/<table> children into json, keyed children
+// become an object and unkeyed ones a list ("_" when both are present).
+func nseValue(elems []nmap.Element, tables []nmap.Table) any {
+	keyed := make(map[string]any)
+	var unkeyed []any
+
+	add := func(key string, v any) {
+		if key == "" {
+			unkeyed = append(unkeyed, v)
+			return
+		}
+		if old, ok := keyed[key]; ok {
+			if list, ok := old.([]any); ok {
+				keyed[key] = append(list, v)
+			} else {
+				keyed[key] = []any{old, v}
+			}
+			return
+		}
+		keyed[key] = v
+	}
+
+	for _, e := range elems {
+		add(e.Key, e.Value)
+	}
+	for _, t := range tables {
+		add(t.Key, nseValue(t.Elements, t.Table))
+	}
+
+	if len(keyed) == 0 {
+		return unkeyed
+	}
+	if len(unkeyed) > 0 {
+		keyed["_"] = unkeyed
+	}
+	return keyed
+}
+
+func scriptData(script nmap.Script) datatypes.JSON {
+	if len(script.Elements) == 0 && len(script.Tables) == 0 {
+		return nil
+	}
+	obj, err := json.Marshal(nseValue(script.Elements, script.Tables))
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+func (s *Script) Structured() any {
+	var v any
+	if len(s.Data) == 0 || json.Unmarshal(s.Data, &v) != nil {
+		return nil
+	}
+	return v
+}
+
+func walkLeaves(v any, path string, fn func(scriptLeaf)) {
+	switch val := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			walkLeaves(val[k], p, fn)
+		}
+	case []any:
+		for _, item := range val {
+			walkLeaves(item, path, fn)
+		}
+	case nil:
+	default:
+		fn(scriptLeaf{Path: path, Value: fmt.Sprint(val)})
+	}
+}
+
+func (s *Script) Leaves() []scriptLeaf {
+	var leaves []scriptLeaf
+	walkLeaves(s.Structured(), "", func(l scriptLeaf) { leaves = append(leaves, l) })
+	return leaves
+}
+
+// findScripts returns the scripts with the given id along with the ip and
+// port (0 for host scripts) they were stored for.
+func findScripts(db *gorm.DB, id string) ([]scriptRef, error) {
+	type scriptRow struct {
+		IP     string
+		Port   uint
+		Script Script `gorm:"embedded"`
+	}
+	var portRows, hostRows []scriptRow
+	err := db.Table("scripts").Select("hosts.ip, ports.port, scripts.*").
+		Joins("JOIN ports ON ports.id = scripts.port_id AND ports.deleted_at IS NULL").
+		Joins("JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL").
+		Where("scripts.title = ? AND scripts.deleted_at IS NULL", id).
+		Order("hosts.ip, ports.port").Scan(&portRows).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Table("scripts").Select("hosts.ip, scripts.*").
+		Joins("JOIN hosts ON hosts.id = scripts.host_id AND hosts.deleted_at IS NULL").
+		Where("scripts.title = ? AND scripts.deleted_at IS NULL", id).
+		Order("hosts.ip").Scan(&hostRows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []scriptRef
+	for _, rows := range [][]scriptRow{portRows, hostRows} {
+		for _, row := range rows {
+			refs = append(refs, scriptRef{IP: row.IP, Port: row.Port, Script: row.Script})
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].IP < refs[j].IP })
+	return refs, nil
+}
+
+func (ref *scriptRef) Addr() string {
+	if ref.Port == 0 {
+		return ref.IP
+	}
+	return net.JoinHostPort(ref.IP, strconv.Itoa(int(ref.Port)))
+}
+
+func sslCertSans(script *Script) []string {
+	var sans []string
+	data, ok := script.Structured().(map[string]any)
+	if !ok {
+		return nil
+	}
+	exts, _ := data["extensions"].([]any)
+	for _, ext := range exts {
+		e, ok := ext.(map[string]any)
+		if !ok || !strings.Contains(fmt.Sprint(e["name"]), "Subject Alternative Name") {
+			continue
+		}
+		for _, san := range strings.Split(fmt.Sprint(e["value"]), ",") {
+			san = strings.TrimSpace(san)
+			if i := strings.Index(san, ":"); i != -1 {
+				san = san[i+1:]
+			}
+			if san != "" {
+				sans = append(sans, san)
+			}
+		}
+	}
+	return sans
+}
+
+// smbSigningWeak reports smb-security-mode / smb2-security-mode results
+// where message signing is disabled or not required.
+func smbSigningWeak(script *Script) (string, bool) {
+	for _, leaf := range script.Leaves() {
+		v := strings.ToLower(leaf.Value)
+		if strings.HasSuffix(leaf.Path, "message_signing") && v != "required" {
+			return leaf.Value, true
+		}
+		if strings.Contains(v, "signing") && (strings.Contains(v, "not required") || strings.Contains(v, "disabled")) {
+			return leaf.Value, true
+		}
+	}
+	return "", false
+}
+
+func NseRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/nse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		q := r.URL.Query()
+		id := q.Get("id")
+		if id == "" {
+			http.Error(w, "missing script id", http.StatusBadRequest)
+			return
+		}
+		key := strings.ToLower(q.Get("key"))
+		contains := strings.ToLower(q.Get("contains"))
+		value := q.Get("value")
+
+		refs, err := findScripts(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, ref := range refs {
+			for _, leaf := range ref.Script.Leaves() {
+				if key != "" && !strings.Contains(strings.ToLower(leaf.Path), key) {
+					continue
+				}
+				if contains != "" && !strings.Contains(strings.ToLower(leaf.Value), contains) {
+					continue
+				}
+				if value != "" && leaf.Value != value {
+					continue
+				}
+				res = res + fmt.Sprintf("%s\t%s\t%s=%s\n", ref.Addr(), id, leaf.Path, leaf.Value)
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/nse/san/{pattern}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		pattern := strings.ToLower(mux.Vars(r)["pattern"])
+		refs, err := findScripts(db, "ssl-cert")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, ref := range refs {
+			for _, san := range sslCertSans(&ref.Script) {
+				if strings.Contains(strings.ToLower(san), pattern) {
+					res = res + fmt.Sprintf("%s\t%s\n", ref.Addr(), san)
+				}
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/nse/smb-signing", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		res := ""
+		for _, id := range []string{"smb-security-mode", "smb2-security-mode"} {
+			refs, err := findScripts(db, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, ref := range refs {
+				if v, ok := smbSigningWeak(&ref.Script); ok {
+					res = res + fmt.Sprintf("%s\t%s\t%s\n", ref.IP, id, v)
+				}
+			}
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
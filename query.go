@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type portRange struct {
+	From uint
+	To   uint
+}
+
+type NmapQuery struct {
+	Ports       []portRange
+	NotPorts    []portRange
+	Protocol    string
+	State       string
+	Services    []string
+	Product     *regexp.Regexp
+	Script      string
+	Output      string
+	Cidrs       []*net.IPNet
+	Hostname    string
+	FirstAfter  time.Time
+	FirstBefore time.Time
+	LastAfter   time.Time
+	LastBefore  time.Time
+	Page        int
+	Limit       int
+	Format      string
+}
+
+type QueryRow struct {
+	IP        string     `json:"ip"`
+	Hostname  string     `json:"hostname"`
+	Port      uint       `json:"port"`
+	Protocol  string     `json:"protocol"`
+	State     string     `json:"state"`
+	Service   string     `json:"service"`
+	Product   string     `json:"product"`
+	Version   string     `json:"version"`
+	Tunnel    string     `json:"tunnel"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	Seen      *time.Time `json:"-"`
+}
+
+func (row *QueryRow) Addr() string {
+	return net.JoinHostPort(row.IP, strconv.Itoa(int(row.Port)))
+}
+
+func parsePortRanges(s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		t := f
+		if isRange {
+			t, err = strconv.ParseUint(to, 10, 16)
+			if err != nil || t < f {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		ranges = append(ranges, portRange{From: uint(f), To: uint(t)})
+	}
+	return ranges, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+func parseCidrs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if strings.Contains(part, ":") {
+				part = part + "/128"
+			} else {
+				part = part + "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", part)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ParseNmapQuery(v url.Values) (*NmapQuery, error) {
+	q := &NmapQuery{
+		Protocol: v.Get("proto"),
+		State:    v.Get("state"),
+		Script:   v.Get("script"),
+		Output:   v.Get("output"),
+		Hostname: strings.ToLower(v.Get("hostname")),
+		Format:   v.Get("format"),
+	}
+	var err error
+	if q.Ports, err = parsePortRanges(v.Get("ports")); err != nil {
+		return nil, err
+	}
+	if q.NotPorts, err = parsePortRanges(v.Get("notports")); err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(v.Get("service"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			q.Services = append(q.Services, s)
+		}
+	}
+	if p := v.Get("product"); p != "" {
+		if q.Product, err = regexp.Compile("(?i)" + p); err != nil {
+			return nil, fmt.Errorf("invalid product regex : %v", err)
+		}
+	}
+	if q.Cidrs, err = parseCidrs(v.Get("cidr")); err != nil {
+		return nil, err
+	}
+	if q.Hostname != "" {
+		if _, err := path.Match(q.Hostname, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname glob %q", q.Hostname)
+		}
+	}
+	for name, t := range map[string]*time.Time{
+		"first_after": &q.FirstAfter, "first_before": &q.FirstBefore,
+		"last_after": &q.LastAfter, "last_before": &q.LastBefore,
+	} {
+		if *t, err = parseQueryTime(v.Get(name)); err != nil {
+			return nil, err
+		}
+	}
+	if p := v.Get("page"); p != "" {
+		if q.Page, err = strconv.Atoi(p); err != nil || q.Page < 1 {
+			return nil, fmt.Errorf("invalid page %q", p)
+		}
+	}
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", l)
+		}
+	}
+	switch q.Format {
+	case "", "text", "json", "csv":
+	default:
+		return nil, fmt.Errorf("unknown format %q", q.Format)
+	}
+	return q, nil
+}
+
+func portRangesSQL(column string, ranges []portRange) (string, []any) {
+	var conds []string
+	var args []any
+	for _, r := range ranges {
+		conds = append(conds, column+" BETWEEN ? AND ?")
+		args = append(args, r.From, r.To)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+func (q *NmapQuery) matchHost(ip, hostname string) bool {
+	if len(q.Cidrs) > 0 {
+		addr := net.ParseIP(ip)
+		found := false
+		for _, n := range q.Cidrs {
+			if addr != nil && n.Contains(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Hostname != "" {
+		if ok, _ := path.Match(q.Hostname, strings.ToLower(hostname)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// cidrKeys returns the ip_key range of a network.
+func cidrKeys(n *net.IPNet) (string, string) {
+	ones, _ := n.Mask.Size()
+	addr, _ := netip.AddrFromSlice(n.IP)
+	first := netip.PrefixFrom(addr.Unmap(), ones).Masked().Addr()
+	b := first.AsSlice()
+	for i := ones; i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return ipSortKey(first.String()), ipSortKey(last.String())
+}
+
+// hostnameLike turns a hostname glob into a LIKE pattern, globs with a
+// character class stay in go.
+func hostnameLike(glob string) (string, bool) {
+	if strings.ContainsAny(glob, "[\\") {
+		return "", false
+	}
+	return strings.NewReplacer("*", "%", "?", "_").Replace(likeEscape(glob)), true
+}
+
+// lastSeenColumn is the last import which saw the host, hosts only added by
+// hand were last seen when created.
+const lastSeenColumn = "COALESCE(hosts.last_seen, hosts.created_at)"
+
+// Run returns the matching ports ordered by address and the total before
+// pagination. Only the product regex and hostname globs with a character
+// class are done in go, the page is then cut in memory.
+func (q *NmapQuery) Run(db *gorm.DB) ([]QueryRow, int, error) {
+	tx := db.Table("ports").
+		Joins("JOIN hosts ON ports.host_id = hosts.id").
+		Where("ports.deleted_at IS NULL AND hosts.deleted_at IS NULL")
+
+	if len(q.Ports) > 0 {
+		cond, args := portRangesSQL("ports.port", q.Ports)
+		tx = tx.Where(cond, args...)
+	}
+	if len(q.NotPorts) > 0 {
+		cond, args := portRangesSQL("ports.port", q.NotPorts)
+		tx = tx.Where("NOT "+cond, args...)
+	}
+	if q.Protocol != "" {
+		tx = tx.Where("ports.protocol = ?", q.Protocol)
+	}
+	if q.State != "" {
+		tx = tx.Where("ports.state = ?", q.State)
+	}
+	if len(q.Services) > 0 {
+		tx = tx.Where("ports.service IN ?", q.Services)
+	}
+	if q.Script != "" || q.Output != "" {
+		sub := db.Table("scripts").Select("port_id").Where("port_id IS NOT NULL AND deleted_at IS NULL")
+		if q.Script != "" {
+			sub = sub.Where("title = ?", q.Script)
+		}
+		if q.Output != "" {
+			sub = sub.Where("LOWER(output) LIKE ?", "%"+strings.ToLower(q.Output)+"%")
+		}
+		tx = tx.Where("ports.id IN (?)", sub)
+	}
+	if len(q.Cidrs) > 0 {
+		var conds []string
+		var args []any
+		for _, n := range q.Cidrs {
+			first, last := cidrKeys(n)
+			conds = append(conds, "hosts.ip_key BETWEEN ? AND ?")
+			args = append(args, first, last)
+		}
+		tx = tx.Where("("+strings.Join(conds, " OR ")+")", args...)
+	}
+	hostnameGlob := q.Hostname
+	if like, ok := hostnameLike(q.Hostname); ok && q.Hostname != "" {
+		tx = tx.Where("LOWER(hosts.hostname) LIKE ? ESCAPE ?", like, `\`)
+		hostnameGlob = ""
+	}
+	if !q.FirstAfter.IsZero() {
+		tx = tx.Where("hosts.created_at >= ?", q.FirstAfter)
+	}
+	if !q.FirstBefore.IsZero() {
+		tx = tx.Where("hosts.created_at < ?", q.FirstBefore)
+	}
+	if !q.LastAfter.IsZero() {
+		tx = tx.Where(lastSeenColumn+" >= ?", q.LastAfter)
+	}
+	if !q.LastBefore.IsZero() {
+		tx = tx.Where(lastSeenColumn+" < ?", q.LastBefore)
+	}
+
+	inGo := q.Product != nil || hostnameGlob != ""
+	var total int64
+	if !inGo {
+		if err := tx.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			return nil, 0, err
+		}
+		if q.Limit > 0 {
+			tx = tx.Limit(q.Limit).Offset((max(q.Page, 1) - 1) * q.Limit)
+		}
+	}
+
+	var rows []QueryRow
+	err := tx.Select("hosts.ip, hosts.hostname, ports.port, ports.protocol, ports.state, ports.service, ports.product, ports.version, ports.tunnel, hosts.created_at AS first_seen, hosts.last_seen AS seen").
+		Order("hosts.ip_key, hosts.ip, ports.port, ports.protocol").Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res := rows[:0]
+	for _, row := range rows {
+		row.LastSeen = row.FirstSeen
+		if row.Seen != nil {
+			row.LastSeen = *row.Seen
+		}
+		if q.Product != nil && !q.Product.MatchString(row.Product+" "+row.Version) {
+			continue
+		}
+		if hostnameGlob != "" {
+			if ok, _ := path.Match(hostnameGlob, strings.ToLower(row.Hostname)); !ok {
+				continue
+			}
+		}
+		res = append(res, row)
+	}
+	if !inGo {
+		return res, int(total), nil
+	}
+
+	n := len(res)
+	if q.Limit > 0 {
+		start := min((max(q.Page, 1)-1)*q.Limit, n)
+		res = res[start:min(start+q.Limit, n)]
+	}
+	return res, n, nil
+}
+
+func writeQueryRows(w http.ResponseWriter, q *NmapQuery, rows []QueryRow, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	switch q.Format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		res, _ := json.MarshalIndent(map[string]any{"total": total, "page": max(q.Page, 1), "limit": q.Limit, "results": rows}, "", "  ")
+		w.Write(res)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ip", "hostname", "port", "protocol", "state", "service", "product", "version", "first_seen", "last_seen"})
+		for _, row := range rows {
+			cw.Write([]string{row.IP, csvCell(row.Hostname), strconv.Itoa(int(row.Port)), row.Protocol, row.State, csvCell(row.Service),
+				csvCell(row.Product), csvCell(row.Version), row.FirstSeen.Format(time.RFC3339), row.LastSeen.Format(time.RFC3339)})
+		}
+		cw.Flush()
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		res := ""
+		for _, row := range rows {
+			res = res + fmt.Sprintf("%s/%s\t%s\t%s\t%s %s\t%s\n", row.Addr(), row.Protocol, row.State, row.Service, row.Product, row.Version, row.Hostname)
+		}
+		w.Write([]byte(res))
+	}
+}
+
+func QueryRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		q, err := ParseNmapQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, total, err := q.Run(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeQueryRows(w, q, rows, total)
+	}).Methods("GET")
+}
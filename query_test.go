@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestIpSortKey(t *testing.T) {
+	ips := []string{"::1", "10.0.0.10", "2001:db8::5", "10.0.0.2", "9.1.1.1", "::ffff:10.0.0.3", "192.168.1.1"}
+	want := []string{"9.1.1.1", "10.0.0.2", "::ffff:10.0.0.3", "10.0.0.10", "192.168.1.1", "::1", "2001:db8::5"}
+	sort.Slice(ips, func(i, j int) bool { return ipSortKey(ips[i]) < ipSortKey(ips[j]) })
+	for i := range want {
+		if ips[i] != want[i] {
+			t.Fatalf("sorted %v, want %v", ips, want)
+		}
+	}
+	if ipSortKey("router") != "" {
+		t.Errorf("invalid address got a key")
+	}
+}
+
+func TestCidrKeys(t *testing.T) {
+	tests := []struct {
+		cidr string
+		in   []string
+		out  []string
+	}{
+		{"10.0.0.0/24", []string{"10.0.0.0", "10.0.0.255", "::ffff:10.0.0.7"}, []string{"10.0.1.0", "9.255.255.255", "::a00:1"}},
+		{"10.0.0.5", []string{"10.0.0.5"}, []string{"10.0.0.4", "10.0.0.6"}},
+		{"0.0.0.0/0", []string{"0.0.0.0", "255.255.255.255"}, []string{"::1"}},
+		{"2001:db8::/32", []string{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"}, []string{"2001:db9::", "10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		nets, err := parseCidrs(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, last := cidrKeys(nets[0])
+		for _, ip := range tt.in {
+			if k := ipSortKey(ip); k < first || k > last {
+				t.Errorf("%s not in %s", ip, tt.cidr)
+			}
+		}
+		for _, ip := range tt.out {
+			if k := ipSortKey(ip); k >= first && k <= last {
+				t.Errorf("%s in %s", ip, tt.cidr)
+			}
+		}
+	}
+}
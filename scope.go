@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	ScopeNone     = "none"
+	ScopeIn       = "in"
+	ScopeOut      = "out"
+	ScopeExcluded = "excluded"
+)
+
+type ScopeEntry struct {
+	gorm.Model
+	Exclude bool
+	Value   string
+	Comment string
+}
+
+type Scope struct {
+	Entries []ScopeEntry
+}
+
+// scopeMatch matches an ip or a hostname against a cidr, a single ip, a
+// range (10.0.0.1-10.0.0.50 or 10.0.0.1-50) or a hostname glob.
+func scopeMatch(value, ip, hostname string) bool {
+	addr, addrErr := netip.ParseAddr(ip)
+
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return addrErr == nil && prefix.Contains(addr)
+	}
+	if single, err := netip.ParseAddr(value); err == nil {
+		return addrErr == nil && single == addr
+	}
+	if from, to, ok := parseIpRange(value); ok {
+		return addrErr == nil && from.Compare(addr) <= 0 && addr.Compare(to) <= 0
+	}
+	if hostname == "" {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(value), strings.ToLower(hostname))
+	return ok
+}
+
+func parseIpRange(value string) (netip.Addr, netip.Addr, bool) {
+	start, end, found := strings.Cut(value, "-")
+	if !found {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	from, err := netip.ParseAddr(strings.TrimSpace(start))
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	end = strings.TrimSpace(end)
+	if !strings.ContainsAny(end, ".:") && from.Is4() {
+		b := from.As4()
+		end = fmt.Sprintf("%d.%d.%d.%s", b[0], b[1], b[2], end)
+	}
+	to, err := netip.ParseAddr(end)
+	if err != nil || to.Less(from) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return from, to, true
+}
+
+func validScopeValue(value string) error {
+	if _, err := netip.ParsePrefix(value); err == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(value); err == nil {
+		return nil
+	}
+	if _, _, ok := parseIpRange(value); ok {
+		return nil
+	}
+	if strings.Contains(value, "/") || net.ParseIP(strings.Split(value, "-")[0]) != nil || strings.Trim(value, "0123456789.-") == "" {
+		return fmt.Errorf("invalid cidr or range %q", value)
+	}
+	if _, err := path.Match(value, ""); err != nil || value == "" {
+		return fmt.Errorf("invalid hostname pattern %q", value)
+	}
+	return nil
+}
+
+func LoadScope(db *gorm.DB) (*Scope, error) {
+	scope := &Scope{}
+	err := db.Order("exclude, id").Find(&scope.Entries).Error
+	return scope, err
+}
+
+// Status returns ScopeNone while no include entry is defined, otherwise
+// exclusions win over inclusions.
+func (s *Scope) Status(ip, hostname string) string {
+	included, hasInclude := false, false
+	for _, e := range s.Entries {
+		if e.Exclude {
+			if scopeMatch(e.Value, ip, hostname) {
+				return ScopeExcluded
+			}
+			continue
+		}
+		hasInclude = true
+		if !included && scopeMatch(e.Value, ip, hostname) {
+			included = true
+		}
+	}
+	if !hasInclude {
+		return ScopeNone
+	}
+	if included {
+		return ScopeIn
+	}
+	return ScopeOut
+}
+
+func scopeOutside(status string) bool {
+	return status == ScopeOut || status == ScopeExcluded
+}
+
+// scopeFilter applies the scope to an inventory import, items outside of
+// it are dropped when reject is set and only flagged otherwise. Each item
+// is reported once.
+type scopeFilter struct {
+	scope    *Scope
+	reject   bool
+	out      io.Writer
+	reported map[string]bool
+}
+
+func newScopeFilter(db *gorm.DB, out io.Writer, reject bool) (*scopeFilter, error) {
+	scope, err := LoadScope(db)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load scope %v", err)
+	}
+	return &scopeFilter{scope: scope, reject: reject, out: out, reported: make(map[string]bool)}, nil
+}
+
+// Keep tells if the item named label, at ip or hostname, is to be imported.
+func (f *scopeFilter) Keep(label, ip, hostname string) bool {
+	status := f.scope.Status(ip, hostname)
+	if !scopeOutside(status) {
+		return true
+	}
+	if !f.reported[label] {
+		f.reported[label] = true
+		if f.reject {
+			fmt.Fprintf(f.out, "rejecting %s out of scope (%s) \n", label, status)
+		} else {
+			fmt.Fprintf(f.out, "WARNING %s out of scope (%s) \n", label, status)
+		}
+	}
+	return !f.reject
+}
+
+// parseScopeLines reads one entry per line, "!" marks an exclusion and the
+// text after the value is its comment.
+func parseScopeLines(content string) ([]ScopeEntry, error) {
+	var entries []ScopeEntry
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e := ScopeEntry{}
+		if strings.HasPrefix(line, "!") {
+			e.Exclude = true
+			line = strings.TrimSpace(line[1:])
+		}
+		value, comment, _ := strings.Cut(line, " ")
+		e.Value, e.Comment = value, strings.TrimSpace(comment)
+		if err := validScopeValue(e.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func addScopeEntries(db *gorm.DB, entries []ScopeEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.Create(&entries).Error
+}
+
+func ScopeRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/scope", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		scope, err := LoadScope(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, e := range scope.Entries {
+			prefix := ""
+			if e.Exclude {
+				prefix = "!"
+			}
+			res = res + fmt.Sprintf("%d\t%s%s\t%s\n", e.ID, prefix, e.Value, e.Comment)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/scope", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] SCOPE ADD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		entries, err := parseScopeLines(r.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		comment := strings.Join(strings.Fields(r.FormValue("comment")), " ")
+		for i := range entries {
+			if r.FormValue("kind") == "exclude" {
+				entries[i].Exclude = true
+			}
+			if comment != "" {
+				entries[i].Comment = comment
+			}
+		}
+		if err := addScopeEntries(db, entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/scope", http.StatusFound)
+			return
+		}
+		for _, e := range entries {
+			w.Write([]byte(fmt.Sprintf("adding %d %s \n", e.ID, e.Value)))
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/scope/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] SCOPE UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries, err := parseScopeLines(string(content))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := addScopeEntries(db, entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, e := range entries {
+			w.Write([]byte(fmt.Sprintf("adding %d %s \n", e.ID, e.Value)))
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/scope/del/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] SCOPE DEL [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		res := db.Unscoped().Delete(&ScopeEntry{}, "id = ?", mux.Vars(r)["id"])
+		if res.Error != nil {
+			http.Error(w, res.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		if res.RowsAffected == 0 {
+			http.Error(w, "scope entry not found", http.StatusNotFound)
+			return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/scope", http.StatusFound)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}).Methods("POST", "DELETE")
+
+	nmapRouter.HandleFunc("/scope/check/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		scope, err := LoadScope(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ip := mux.Vars(r)["ip"]
+		var host Host
+		if err := db.Select("hostname").Limit(1).Find(&host, "IP = ?", ip).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(scope.Status(ip, host.Hostname) + "\n"))
+	}).Methods("GET")
+}
+
+func ScopeHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Printf("[%s] SCOPE VIEW [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+
+	db := database
+
+	t, err := template.ParseFS(tpls, "templates/base.html", "templates/scope.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scope, err := LoadScope(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tr := TemplateRender{Title: "scope", Data: scope.Entries, Sidebar: GenerateJsonNav()}
+
+	if err := t.ExecuteTemplate(w, "base", tr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseScopeLines(t *testing.T) {
+	entries, err := parseScopeLines("# engagement\n10.0.0.0/16 main site\n\n!10.0.5.0/24   printers\n*.corp.local\n10.1.0.1-50\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScopeEntry{
+		{Value: "10.0.0.0/16", Comment: "main site"},
+		{Value: "10.0.5.0/24", Comment: "printers", Exclude: true},
+		{Value: "*.corp.local"},
+		{Value: "10.1.0.1-50"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Value != want[i].Value || e.Comment != want[i].Comment || e.Exclude != want[i].Exclude {
+			t.Errorf("entry %d = %q %q %v, want %q %q %v", i, e.Value, e.Comment, e.Exclude, want[i].Value, want[i].Comment, want[i].Exclude)
+		}
+	}
+
+	for _, line := range []string{"10.0.0.0/33", "10.0.0.300", "10.0.0.9-10.0.0.1", "[corp"} {
+		if _, err := parseScopeLines(line); err == nil {
+			t.Errorf("parseScopeLines(%q) accepted", line)
+		}
+	}
+}
+
+func TestScopeStatus(t *testing.T) {
+	entries, err := parseScopeLines("10.0.0.0/16\n10.1.0.1-50\n*.corp.local\n!10.0.5.0/24\n!dc01.corp.local\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := &Scope{Entries: entries}
+	tests := []struct {
+		ip       string
+		hostname string
+		want     string
+	}{
+		{"10.0.1.1", "", ScopeIn},
+		{"10.0.5.1", "", ScopeExcluded},
+		{"10.1.0.50", "", ScopeIn},
+		{"10.1.0.51", "", ScopeOut},
+		{"192.168.1.1", "web.corp.local", ScopeIn},
+		{"192.168.1.1", "WEB.CORP.LOCAL", ScopeIn},
+		{"10.0.1.1", "dc01.corp.local", ScopeExcluded},
+		{"192.168.1.1", "", ScopeOut},
+		{"fe80::1", "", ScopeOut},
+	}
+	for _, tt := range tests {
+		if got := scope.Status(tt.ip, tt.hostname); got != tt.want {
+			t.Errorf("Status(%q, %q) = %s, want %s", tt.ip, tt.hostname, got, tt.want)
+		}
+	}
+
+	if got := (&Scope{}).Status("10.0.0.1", ""); got != ScopeNone {
+		t.Errorf("empty scope = %s, want %s", got, ScopeNone)
+	}
+}
+
+func TestScopeFilterKeep(t *testing.T) {
+	entries, _ := parseScopeLines("10.0.0.0/24\n")
+	for _, reject := range []bool{false, true} {
+		var out bytes.Buffer
+		f := &scopeFilter{scope: &Scope{Entries: entries}, reject: reject, out: &out, reported: make(map[string]bool)}
+		if !f.Keep("10.0.0.1", "10.0.0.1", "") {
+			t.Errorf("reject=%v dropped an in scope host", reject)
+		}
+		if got := f.Keep("10.0.1.1", "10.0.1.1", ""); got == reject {
+			t.Errorf("reject=%v Keep out of scope = %v", reject, got)
+		}
+		f.Keep("10.0.1.1", "10.0.1.1", "")
+		if n := strings.Count(out.String(), "10.0.1.1"); n != 1 {
+			t.Errorf("reject=%v reported %d times:\n%s", reject, n, out.String())
+		}
+	}
+}
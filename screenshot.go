@@ -0,0 +1,620 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	shotMaxSize  = 32 << 20
+	shotSimilar  = 10 // max differing dHash bits within a group
+	shotMaxFiles = 10000
+)
+
+// Screenshot is a web page capture stored under files/screenshots, it is
+// linked to the port of its address once scanned.
+type Screenshot struct {
+	gorm.Model
+	PortID *uint  `gorm:"index"`
+	IP     string `gorm:"size:64;index"`
+	Port   uint
+	URL    string
+	File   string
+	Title  string
+	Status int
+	Hash   string `gorm:"size:16"`
+	Source string
+}
+
+func (s *Screenshot) Addr() string {
+	if strings.Contains(s.IP, ":") {
+		return fmt.Sprintf("[%s]:%d", s.IP, s.Port)
+	}
+	return fmt.Sprintf("%s:%d", s.IP, s.Port)
+}
+
+// dHash is the difference hash of the image, each bit tells if a cell of
+// a 9x8 grayscale reduction is darker than its right neighbour.
+func dHash(img image.Image) uint64 {
+	b := img.Bounds()
+	var gray [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/8, b.Min.Y+(y+1)*b.Dy()/8
+		for x := 0; x < 9; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/9, b.Min.X+(x+1)*b.Dx()/9
+			stepX, stepY := max(1, (x1-x0)/16), max(1, (y1-y0)/16)
+			sum, n := 0.0, 0
+			for py := y0; py < y1; py += stepY {
+				for px := x0; px < x1; px += stepX {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			if n > 0 {
+				gray[y][x] = sum / float64(n)
+			}
+		}
+	}
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray[y][x] < gray[y][x+1] {
+				h |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return h
+}
+
+// screenshotGroups clusters the screenshots whose hashes differ by at most
+// shotSimilar bits, largest groups first.
+func screenshotGroups(shots []Screenshot) [][]Screenshot {
+	parent := make([]int, len(shots))
+	hashes := make([]uint64, len(shots))
+	for i := range shots {
+		parent[i] = i
+		hashes[i], _ = strconv.ParseUint(shots[i].Hash, 16, 64)
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range shots {
+		for j := i + 1; j < len(shots); j++ {
+			if shots[i].Hash != "" && shots[j].Hash != "" && bits.OnesCount64(hashes[i]^hashes[j]) <= shotSimilar {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	index := make(map[int]int)
+	var groups [][]Screenshot
+	for i := range shots {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], shots[i])
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i]) > len(groups[j]) })
+	return groups
+}
+
+type shotMeta struct {
+	URL    string
+	IP     string
+	Title  string
+	Status int
+}
+
+func metaString(obj map[string]any, keys ...string) string {
+	for _, k := range keys {
+		switch v := obj[k].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case []any:
+			if len(v) > 0 {
+				if s, ok := v[0].(string); ok {
+					return s
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// collectShotMeta walks the json written by screenshot tools (aquatone
+// session, gowitness jsonl...) and indexes url, title and status by the
+// base name of the screenshot file.
+func collectShotMeta(v any, meta map[string]shotMeta) {
+	switch val := v.(type) {
+	case map[string]any:
+		if file := metaString(val, "screenshotPath", "screenshot_path", "file_name", "filename", "screenshot"); isShotImage(file) {
+			m := shotMeta{
+				URL:   metaString(val, "url", "URL", "final_url"),
+				IP:    metaString(val, "addrs", "ip", "address"),
+				Title: metaString(val, "pageTitle", "page_title", "title"),
+			}
+			for _, k := range []string{"status", "status_code", "statusCode", "response_code"} {
+				switch s := val[k].(type) {
+				case float64:
+					m.Status = int(s)
+				case string:
+					m.Status, _ = strconv.Atoi(strings.Fields(s + " ")[0])
+				}
+				if m.Status != 0 {
+					break
+				}
+			}
+			meta[strings.ToLower(path.Base(strings.ReplaceAll(file, "\\", "/")))] = m
+		}
+		for _, e := range val {
+			collectShotMeta(e, meta)
+		}
+	case []any:
+		for _, e := range val {
+			collectShotMeta(e, meta)
+		}
+	}
+}
+
+func isShotImage(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+var shotIPRe = regexp.MustCompile(`(?:^|[^0-9])(\d{1,3})[._-](\d{1,3})[._-](\d{1,3})[._-](\d{1,3})(?:[._:-]+(\d{1,5}))?`)
+var shotPortRe = regexp.MustCompile(`^[._:-]+(\d{1,5})`)
+var shotSepRe = regexp.MustCompile(`[_-]+`)
+
+func shotDefaultPort(scheme string) int {
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// shotTarget guesses the url of a screenshot from its file name, tools
+// name them like https-10.0.0.5-8443.png or http__web_corp_local__80.png,
+// names are only recognized when known from dns or nmap.
+func shotTarget(name string, names []string) (string, bool) {
+	stem := strings.ToLower(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	scheme := "http"
+	if strings.HasPrefix(stem, "https") {
+		scheme = "https"
+	}
+	if m := shotIPRe.FindStringSubmatch(stem); m != nil {
+		if addr, err := netip.ParseAddr(strings.Join(m[1:5], ".")); err == nil {
+			port, _ := strconv.Atoi(m[5])
+			if port == 0 || port > 65535 {
+				port = shotDefaultPort(scheme)
+			}
+			return fmt.Sprintf("%s://%s:%d/", scheme, addr, port), true
+		}
+	}
+	dotted := shotSepRe.ReplaceAllString(stem, ".")
+	for _, n := range names {
+		dn := shotSepRe.ReplaceAllString(n, ".")
+		i := strings.Index(dotted, dn)
+		if i < 0 {
+			continue
+		}
+		port := shotDefaultPort(scheme)
+		if m := shotPortRe.FindStringSubmatch(dotted[i+len(dn):]); m != nil {
+			if p, _ := strconv.Atoi(m[1]); p > 0 && p <= 65535 {
+				port = p
+			}
+		}
+		return fmt.Sprintf("%s://%s:%d/", scheme, n, port), true
+	}
+	return "", false
+}
+
+// knownNames lists the dns and nmap hostnames, longest first so the most
+// specific name matches.
+func knownNames(db *gorm.DB) ([]string, error) {
+	var names, hostnames []string
+	if err := db.Model(&DnsRecord{}).Distinct().Pluck("name", &names).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&Host{}).Where("hostname <> ''").Pluck("hostname", &hostnames).Error; err != nil {
+		return nil, err
+	}
+	names = append(names, hostnames...)
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	return names, nil
+}
+
+type shotFile struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+func readShotFile(f shotFile) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(io.LimitReader(rc, shotMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > shotMaxSize {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	return content, nil
+}
+
+// zipShotFiles lists the entries of a zip export.
+func zipShotFiles(r io.ReaderAt, size int64) ([]shotFile, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read zip %v", err)
+	}
+	var files []shotFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, shotFile{Name: f.Name, Open: f.Open})
+	}
+	return files, nil
+}
+
+func screenshotTitle(db *gorm.DB, shot *Screenshot) error {
+	var titles []string
+	err := db.Model(&Script{}).Joins("JOIN ports ON ports.id = scripts.port_id AND ports.deleted_at IS NULL").
+		Joins("JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL").
+		Where("hosts.ip = ? AND ports.port = ? AND scripts.title = ?", shot.IP, shot.Port, "http-title").
+		Limit(1).Pluck("scripts.output", &titles).Error
+	if err == nil && len(titles) > 0 {
+		shot.Title = strings.TrimSpace(titles[0])
+	}
+	return err
+}
+
+// importScreenshots stores the images of files, their target comes from
+// the tool json found along, the file name, or def for a single upload.
+// Screenshots of targets outside the scope go through filter.
+func importScreenshots(db *gorm.DB, w io.Writer, filter *scopeFilter, files []shotFile, def shotMeta, source string) (int, error) {
+	if len(files) > shotMaxFiles {
+		return 0, fmt.Errorf("too many files (%d)", len(files))
+	}
+	meta := make(map[string]shotMeta)
+	for _, f := range files {
+		ext := strings.ToLower(path.Ext(f.Name))
+		if ext != ".json" && ext != ".jsonl" {
+			continue
+		}
+		content, err := readShotFile(f)
+		if err != nil {
+			return 0, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(content))
+		for {
+			var v any
+			if dec.Decode(&v) != nil {
+				break
+			}
+			collectShotMeta(v, meta)
+		}
+	}
+	names, err := knownNames(db)
+	if err != nil {
+		return 0, err
+	}
+	resolver := newNameResolver(db)
+
+	var known []string
+	if err := db.Model(&Screenshot{}).Pluck("file", &known).Error; err != nil {
+		return 0, err
+	}
+	stored := make(map[string]bool)
+	for _, f := range known {
+		stored[f] = true
+	}
+
+	var shots []Screenshot
+	for _, f := range files {
+		if !isShotImage(f.Name) {
+			continue
+		}
+		content, err := readShotFile(f)
+		if err != nil {
+			return 0, err
+		}
+		img, format, err := image.Decode(bytes.NewReader(content))
+		if err != nil {
+			fmt.Fprintf(w, "skipping %s not an image \n", f.Name)
+			continue
+		}
+
+		m, ok := meta[strings.ToLower(path.Base(f.Name))]
+		if !ok {
+			m = def
+			if target, ok := shotTarget(f.Name, names); ok && def.URL == "" && def.IP == "" {
+				m.URL = target
+			}
+		}
+		shot := Screenshot{URL: m.URL, IP: m.IP, Title: m.Title, Status: m.Status, Source: source}
+		hostname := ""
+		if u, err := url.Parse(m.URL); err == nil && u.Host != "" {
+			port, _ := strconv.Atoi(u.Port())
+			if port == 0 {
+				port = shotDefaultPort(u.Scheme)
+			}
+			shot.Port = uint(port)
+			if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+				shot.IP = addr.String()
+			} else {
+				hostname = u.Hostname()
+				if shot.IP == "" {
+					if shot.IP, err = resolver.IP(hostname); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+		if shot.IP == "" || shot.Port == 0 {
+			fmt.Fprintf(w, "skipping %s no ip:port found \n", f.Name)
+			continue
+		}
+		if !filter.Keep(shot.Addr(), shot.IP, hostname) {
+			continue
+		}
+
+		sum := sha256.Sum256(content)
+		shot.File = fmt.Sprintf("screenshots/%s_%d_%s.%s", strings.ReplaceAll(shot.IP, ":", "_"), shot.Port, hex.EncodeToString(sum[:6]), format)
+		if stored[shot.File] {
+			continue
+		}
+		stored[shot.File] = true
+		if err := (&Attachment{Filename: shot.File, Content: content}).save(); err != nil {
+			return 0, err
+		}
+		shot.Hash = fmt.Sprintf("%016x", dHash(img))
+		if shot.Title == "" {
+			if err := screenshotTitle(db, &shot); err != nil {
+				return 0, err
+			}
+		}
+		fmt.Fprintf(w, "adding %s %s \n", shot.Addr(), shot.File)
+		shots = append(shots, shot)
+	}
+	if len(shots) > 0 {
+		if err := db.CreateInBatches(shots, 200).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(shots), linkScreenshots(db)
+}
+
+func linkScreenshots(db *gorm.DB) error {
+	return db.Model(&Screenshot{}).Where("1 = 1").
+		Update("port_id", gorm.Expr("(SELECT ports.id FROM ports JOIN hosts ON hosts.id = ports.host_id AND hosts.deleted_at IS NULL WHERE hosts.ip = screenshots.ip AND ports.port = screenshots.port AND ports.protocol = 'tcp' AND ports.deleted_at IS NULL LIMIT 1)")).Error
+}
+
+// statusFilter matches an exact status or a class like 4xx.
+func statusFilter(tx *gorm.DB, status string) (*gorm.DB, error) {
+	if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+		low := int(status[0]-'0') * 100
+		return tx.Where("status >= ? AND status < ?", low, low+100), nil
+	}
+	n, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status %q", status)
+	}
+	return tx.Where("status = ?", n), nil
+}
+
+func findScreenshots(db *gorm.DB, v url.Values) ([]Screenshot, error) {
+	tx := db.Order("ip, port, id")
+	if s := v.Get("title"); s != "" {
+		tx = tx.Where("LOWER(title) LIKE ?", "%"+strings.ToLower(s)+"%")
+	}
+	if s := v.Get("status"); s != "" {
+		var err error
+		if tx, err = statusFilter(tx, s); err != nil {
+			return nil, err
+		}
+	}
+	var shots []Screenshot
+	err := tx.Find(&shots).Error
+	return shots, err
+}
+
+func ScreenshotRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/screenshots/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] SCREENSHOT UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		var files []shotFile
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			// a form with several files or a directory picked in the gallery
+			if err := r.ParseMultipartForm(64 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer r.MultipartForm.RemoveAll()
+			for _, headers := range r.MultipartForm.File {
+				for _, fh := range headers {
+					fh := fh
+					if strings.ToLower(path.Ext(fh.Filename)) != ".zip" {
+						files = append(files, shotFile{Name: fh.Filename, Open: func() (io.ReadCloser, error) { return fh.Open() }})
+						continue
+					}
+					f, err := fh.Open()
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					defer f.Close()
+					entries, err := zipShotFiles(f, fh.Size)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					files = append(files, entries...)
+				}
+			}
+		} else {
+			spool, err := os.CreateTemp("", "wikix-shot-*")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+			size, err := io.Copy(spool, r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			magic := make([]byte, 4)
+			spool.ReadAt(magic, 0)
+			if bytes.Equal(magic, []byte("PK\x03\x04")) {
+				if files, err = zipShotFiles(spool, size); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			} else {
+				name := r.FormValue("name")
+				if name == "" {
+					name = "upload.png"
+				}
+				files = []shotFile{{Name: name, Open: func() (io.ReadCloser, error) {
+					return io.NopCloser(io.NewSectionReader(spool, 0, size)), nil
+				}}}
+			}
+		}
+
+		def := shotMeta{URL: r.FormValue("url"), IP: r.FormValue("ip"), Title: r.FormValue("title")}
+		def.Status, _ = strconv.Atoi(r.FormValue("status"))
+		port, _ := strconv.Atoi(r.FormValue("port"))
+		if def.IP != "" {
+			if _, err := netip.ParseAddr(def.IP); err != nil {
+				http.Error(w, fmt.Sprintf("invalid ip %q", def.IP), http.StatusBadRequest)
+				return
+			}
+			if port <= 0 || port > 65535 {
+				http.Error(w, "missing port", http.StatusBadRequest)
+				return
+			}
+			scheme := "http"
+			if port == 443 || port == 8443 {
+				scheme = "https"
+			}
+			def.URL = fmt.Sprintf("%s://%s/", scheme, (&Screenshot{IP: def.IP, Port: uint(port)}).Addr())
+		}
+		source := r.FormValue("source")
+		if source == "" {
+			source = "upload"
+		}
+
+		var out bytes.Buffer
+		filter, err := newScopeFilter(db, &out, r.FormValue("scope") == "reject")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err := importScreenshots(db, &out, filter, files, def, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/screenshots", http.StatusFound)
+			return
+		}
+		out.WriteTo(w)
+		w.Write([]byte(fmt.Sprintf("%d screenshots added \nOK\n", n)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/screenshots", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		shots, err := findScreenshots(db, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := ""
+		for _, s := range shots {
+			res = res + fmt.Sprintf("%s\t%d\t%s\t/dl/%s\n", s.Addr(), s.Status, s.Title, s.File)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
+
+type ScreenshotView struct {
+	Title  string
+	Status string
+	Group  bool
+	Groups [][]Screenshot
+}
+
+func ScreenshotsHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Printf("[%s] SCREENSHOTS VIEW [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+
+	db := database
+
+	t, err := template.ParseFS(tpls, "templates/base.html", "templates/screenshots.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	v := r.URL.Query()
+	shots, err := findScreenshots(db, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view := ScreenshotView{Title: v.Get("title"), Status: v.Get("status"), Group: v.Get("group") != ""}
+	if view.Group {
+		view.Groups = screenshotGroups(shots)
+	} else if len(shots) > 0 {
+		view.Groups = [][]Screenshot{shots}
+	}
+
+	tr := TemplateRender{Title: "screenshots", Data: view, Sidebar: GenerateJsonNav()}
+
+	if err := t.ExecuteTemplate(w, "base", tr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
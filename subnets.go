@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type subnetHost struct {
+	IP       string
+	Hostname string
+	Status   string
+	Assignee string
+	Router   bool
+	Open     int
+}
+
+type Subnet struct {
+	Prefix netip.Prefix
+	Hosts  []subnetHost
+	Open   int
+}
+
+func subnetHosts(db *gorm.DB) ([]subnetHost, error) {
+	var hosts []subnetHost
+	err := db.Table("hosts").
+		Select("hosts.ip, hosts.hostname, hosts.status, hosts.assignee, hosts.router, COUNT(ports.id) AS open").
+		Joins("LEFT JOIN ports ON ports.host_id = hosts.id AND ports.state = ? AND ports.deleted_at IS NULL", "open").
+		Where("hosts.deleted_at IS NULL").
+		Group("hosts.ip, hosts.hostname, hosts.status, hosts.assignee, hosts.router").
+		Scan(&hosts).Error
+	return hosts, err
+}
+
+func parsePrefixLen(s string) (int, error) {
+	if s == "" {
+		return 24, nil
+	}
+	bits, err := strconv.Atoi(s)
+	if err != nil || bits < 0 || bits > 32 {
+		return 0, fmt.Errorf("invalid prefix %q", s)
+	}
+	return bits, nil
+}
+
+// GroupSubnets groups hosts by ipv4 prefix of the given length, ipv6 hosts
+// are grouped by /64, unparsable addresses are left out.
+func GroupSubnets(hosts []subnetHost, bits int) []*Subnet {
+	bySubnet := make(map[netip.Prefix]*Subnet)
+	for _, host := range hosts {
+		addr, err := netip.ParseAddr(host.IP)
+		if err != nil {
+			continue
+		}
+		b := bits
+		if !addr.Is4() {
+			b = 64
+		}
+		prefix, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		subnet, ok := bySubnet[prefix]
+		if !ok {
+			subnet = &Subnet{Prefix: prefix}
+			bySubnet[prefix] = subnet
+		}
+		subnet.Hosts = append(subnet.Hosts, host)
+		subnet.Open += host.Open
+	}
+
+	var subnets []*Subnet
+	for _, subnet := range bySubnet {
+		sort.Slice(subnet.Hosts, func(i, j int) bool {
+			a, _ := netip.ParseAddr(subnet.Hosts[i].IP)
+			b, _ := netip.ParseAddr(subnet.Hosts[j].IP)
+			return a.Less(b)
+		})
+		subnets = append(subnets, subnet)
+	}
+	sort.Slice(subnets, func(i, j int) bool {
+		return subnets[i].Prefix.Addr().Less(subnets[j].Prefix.Addr())
+	})
+	return subnets
+}
+
+func SubnetRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/subnets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		bits, err := parsePrefixLen(r.URL.Query().Get("prefix"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cidrs, err := parseCidrs(r.URL.Query().Get("cidr"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hosts, err := subnetHosts(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q := &NmapQuery{Cidrs: cidrs}
+		var selected []subnetHost
+		for _, host := range hosts {
+			if q.matchHost(host.IP, "") {
+				selected = append(selected, host)
+			}
+		}
+		res := ""
+		for _, subnet := range GroupSubnets(selected, bits) {
+			res = res + fmt.Sprintf("%s\thosts=%d\topen=%d\n", subnet.Prefix, len(subnet.Hosts), subnet.Open)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+}
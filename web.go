@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// WebEndpoint is a distinct request seen in a proxy or browser capture,
+// Params holds the sorted names of the query and body parameters.
+type WebEndpoint struct {
+	gorm.Model
+	HostID      *uint  `gorm:"index"`
+	PortID      *uint  `gorm:"index"`
+	IP          string `gorm:"size:64;index"`
+	Port        uint
+	Method      string `gorm:"size:16"`
+	URL         string
+	Params      string
+	Status      int
+	ContentType string `gorm:"size:128"`
+	Source      string
+}
+
+func (e *WebEndpoint) key() string {
+	return fmt.Sprintf("%s %s %s %d %s", e.Method, e.URL, e.Params, e.Status, e.ContentType)
+}
+
+// Origin returns the scheme, host and port of the endpoint url.
+func (e *WebEndpoint) Origin() string {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return e.URL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (e *WebEndpoint) Path() string {
+	u, err := url.Parse(e.URL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// httpHeaders splits a raw http message into its lower cased headers and
+// body.
+func httpHeaders(raw []byte) (map[string]string, []byte) {
+	head, body, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !ok {
+		head, body, _ = bytes.Cut(raw, []byte("\n\n"))
+	}
+	headers := make(map[string]string)
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	for _, line := range lines[min(1, len(lines)):] {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			headers[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	return headers, body
+}
+
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// bodyParams returns the parameter names of a form, multipart or json body.
+func bodyParams(contentType string, body []byte) []string {
+	var names []string
+	t, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case t == "application/x-www-form-urlencoded":
+		values, _ := url.ParseQuery(string(body))
+		for k := range values {
+			names = append(names, k)
+		}
+	case t == "multipart/form-data":
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			if name := part.FormName(); name != "" {
+				names = append(names, name)
+			}
+		}
+	case strings.HasSuffix(t, "json"):
+		var obj map[string]any
+		if json.Unmarshal(body, &obj) == nil {
+			for k := range obj {
+				names = append(names, k)
+			}
+		}
+	}
+	return names
+}
+
+// newWebEndpoint normalizes a captured request, the query is replaced by
+// the parameter names and the default port is dropped from the url.
+func newWebEndpoint(method, rawURL, ip string, status int, contentType string, params []string) (WebEndpoint, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return WebEndpoint{}, false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	port, _ := strconv.Atoi(u.Port())
+	if port == 0 {
+		port = 80
+		if scheme == "https" || scheme == "wss" {
+			port = 443
+		}
+	}
+	hostname := strings.ToLower(u.Hostname())
+	host := hostname
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if !((scheme == "http" || scheme == "ws") && port == 80) && !((scheme == "https" || scheme == "wss") && port == 443) {
+		host = fmt.Sprintf("%s:%d", host, port)
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	for k := range u.Query() {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	params = dedupSorted(params)
+
+	if ip == "" {
+		if addr, err := netip.ParseAddr(hostname); err == nil {
+			ip = addr.String()
+		}
+	}
+	return WebEndpoint{
+		IP:          ip,
+		Port:        uint(port),
+		Method:      strings.ToUpper(method),
+		URL:         scheme + "://" + host + path,
+		Params:      strings.Join(params, ","),
+		Status:      status,
+		ContentType: mediaType(contentType),
+	}, true
+}
+
+func dedupSorted(s []string) []string {
+	var res []string
+	for i, v := range s {
+		if v != "" && (i == 0 || v != s[i-1]) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+type burpData struct {
+	Base64 bool   `xml:"base64,attr"`
+	Data   string `xml:",chardata"`
+}
+
+func (d burpData) bytes() []byte {
+	if !d.Base64 {
+		return []byte(d.Data)
+	}
+	res, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(d.Data))
+	return res
+}
+
+type burpItem struct {
+	URL  string `xml:"url"`
+	Host struct {
+		IP string `xml:"ip,attr"`
+	} `xml:"host"`
+	Method   string   `xml:"method"`
+	Request  burpData `xml:"request"`
+	Status   string   `xml:"status"`
+	Response burpData `xml:"response"`
+}
+
+// parseBurp streams the items of a burp "save items" export.
+func parseBurp(src io.Reader, add func(WebEndpoint)) error {
+	dec := xml.NewDecoder(src)
+	dec.Strict = false
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to parse burp xml %v", err)
+		}
+		se, ok := token.(xml.StartElement)
+		if !ok || se.Name.Local != "item" {
+			continue
+		}
+		var item burpItem
+		if err := dec.DecodeElement(&item, &se); err != nil {
+			return fmt.Errorf("unable to parse burp xml %v", err)
+		}
+		reqHeaders, body := httpHeaders(item.Request.bytes())
+		respHeaders, _ := httpHeaders(item.Response.bytes())
+		status, _ := strconv.Atoi(strings.TrimSpace(item.Status))
+		e, ok := newWebEndpoint(strings.TrimSpace(item.Method), strings.TrimSpace(item.URL), item.Host.IP,
+			status, respHeaders["content-type"], bodyParams(reqHeaders["content-type"], body))
+		if ok {
+			add(e)
+		}
+	}
+}
+
+type harParam struct {
+	Name string `json:"name"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method      string     `json:"method"`
+				URL         string     `json:"url"`
+				QueryString []harParam `json:"queryString"`
+				PostData    *struct {
+					MimeType string     `json:"mimeType"`
+					Params   []harParam `json:"params"`
+					Text     string     `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					MimeType string `json:"mimeType"`
+				} `json:"content"`
+			} `json:"response"`
+			ServerIPAddress string `json:"serverIPAddress"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+func parseHar(src io.Reader, add func(WebEndpoint)) error {
+	var har harFile
+	if err := json.NewDecoder(src).Decode(&har); err != nil {
+		return fmt.Errorf("unable to parse har %v", err)
+	}
+	for _, entry := range har.Log.Entries {
+		var params []string
+		for _, p := range entry.Request.QueryString {
+			params = append(params, p.Name)
+		}
+		if post := entry.Request.PostData; post != nil {
+			for _, p := range post.Params {
+				params = append(params, p.Name)
+			}
+			if len(post.Params) == 0 {
+				params = append(params, bodyParams(post.MimeType, []byte(post.Text))...)
+			}
+		}
+		ip := strings.Trim(entry.ServerIPAddress, "[]")
+		if _, err := netip.ParseAddr(ip); err != nil {
+			ip = ""
+		}
+		e, ok := newWebEndpoint(entry.Request.Method, entry.Request.URL, ip,
+			entry.Response.Status, entry.Response.Content.MimeType, params)
+		if ok {
+			add(e)
+		}
+	}
+	return nil
+}
+
+// resolveWebIPs fills the address of endpoints captured by name.
+func resolveWebIPs(db *gorm.DB, endpoints []WebEndpoint) error {
+	resolver := newNameResolver(db)
+	for i := range endpoints {
+		e := &endpoints[i]
+		if e.IP != "" {
+			continue
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			continue
+		}
+		if e.IP, err = resolver.IP(u.Hostname()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWebEndpoints stores the endpoints in scope not already known and links
+// them to the scanned hosts and ports.
+func addWebEndpoints(db *gorm.DB, filter *scopeFilter, endpoints []WebEndpoint) (int, error) {
+	if err := resolveWebIPs(db, endpoints); err != nil {
+		return 0, err
+	}
+	var known []WebEndpoint
+	if err := db.Select("method", "url", "params", "status", "content_type").Find(&known).Error; err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	for i := range known {
+		seen[known[i].key()] = true
+	}
+	var added []WebEndpoint
+	for i := range endpoints {
+		e := &endpoints[i]
+		hostname := ""
+		if u, err := url.Parse(e.URL); err == nil {
+			hostname = u.Hostname()
+		}
+		if !filter.Keep(e.Origin(), e.IP, hostname) {
+			continue
+		}
+		if key := e.key(); !seen[key] {
+			seen[key] = true
+			added = append(added, endpoints[i])
+		}
+	}
+	if len(added) > 0 {
+		if err := db.CreateInBatches(added, 500).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(added), linkWebEndpoints(db)
+}
+
+func linkWebEndpoints(db *gorm.DB) error {
+	err := db.Model(&WebEndpoint{}).Where("ip <> ''").
+		Update("host_id", gorm.Expr("(SELECT hosts.id FROM hosts WHERE hosts.ip = web_endpoints.ip AND hosts.deleted_at IS NULL LIMIT 1)")).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&WebEndpoint{}).Where("host_id IS NOT NULL").
+		Update("port_id", gorm.Expr("(SELECT ports.id FROM ports WHERE ports.host_id = web_endpoints.host_id AND ports.port = web_endpoints.port AND ports.protocol = 'tcp' AND ports.deleted_at IS NULL LIMIT 1)")).Error
+}
+
+// linkInventory points the dns records, web endpoints, screenshots and ad
+// computers to the current hosts and ports, it runs whenever hosts or ports
+// are added.
+func linkInventory(db *gorm.DB) error {
+	if err := linkDnsRecords(db); err != nil {
+		return err
+	}
+	if err := linkWebEndpoints(db); err != nil {
+		return err
+	}
+	if err := linkScreenshots(db); err != nil {
+		return err
+	}
+	return linkAdComputers(db)
+}
+
+// siteMap renders the endpoints, ordered by url, as an indented path tree
+// per origin.
+func siteMap(endpoints []WebEndpoint) string {
+	res := ""
+	origin := ""
+	var prev []string
+	for _, e := range endpoints {
+		if o := e.Origin(); o != origin {
+			origin, prev = o, nil
+			res = res + o + "\n"
+		}
+		segs := strings.Split(strings.Trim(e.Path(), "/"), "/")
+		k := 0
+		for k < len(segs)-1 && k < len(prev)-1 && segs[k] == prev[k] {
+			k++
+		}
+		for i := k; i < len(segs)-1; i++ {
+			res = res + strings.Repeat("  ", i+1) + segs[i] + "/\n"
+		}
+		leaf := segs[len(segs)-1]
+		if leaf == "" {
+			leaf = "/"
+		}
+		params := ""
+		if e.Params != "" {
+			params = " [" + e.Params + "]"
+		}
+		res = res + fmt.Sprintf("%s%s  %s %d %s%s\n", strings.Repeat("  ", len(segs)), leaf, e.Method, e.Status, e.ContentType, params)
+		prev = segs
+	}
+	return res
+}
+
+// sniff returns the first significant byte of src without consuming it.
+func sniff(src *bufio.Reader) byte {
+	if bom, _ := src.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		src.Discard(3)
+	}
+	for {
+		b, err := src.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			src.UnreadByte()
+			return b
+		}
+	}
+}
+
+func WebRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/web/up", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] WEB UPLOAD [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		source := r.URL.Query().Get("source")
+		var endpoints []WebEndpoint
+		add := func(e WebEndpoint) {
+			e.Source = source
+			endpoints = append(endpoints, e)
+		}
+		src := bufio.NewReader(r.Body)
+		var err error
+		switch sniff(src) {
+		case '<':
+			if source == "" {
+				source = "burp"
+			}
+			err = parseBurp(src, add)
+		case '{':
+			if source == "" {
+				source = "har"
+			}
+			err = parseHar(src, add)
+		default:
+			err = fmt.Errorf("expecting burp xml or har")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := newScopeFilter(db, w, r.URL.Query().Get("scope") == "reject")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err := addWebEndpoints(db, filter, endpoints)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("read %d requests, %d new endpoints \nOK\n", len(endpoints), n)))
+	}).Methods("POST")
+
+	nmapRouter.HandleFunc("/web", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		v := r.URL.Query()
+		tx := db.Order("url, method, status")
+		if s := v.Get("q"); s != "" {
+			tx = tx.Where("url LIKE ? OR params LIKE ?", "%"+s+"%", "%"+s+"%")
+		}
+		if s := v.Get("ip"); s != "" {
+			tx = tx.Where("ip = ?", s)
+		}
+		if s := v.Get("port"); s != "" {
+			tx = tx.Where("port = ?", s)
+		}
+		if s := v.Get("method"); s != "" {
+			tx = tx.Where("method = ?", strings.ToUpper(s))
+		}
+		if s := v.Get("status"); s != "" {
+			tx = tx.Where("status = ?", s)
+		}
+		if s := v.Get("type"); s != "" {
+			tx = tx.Where("content_type LIKE ?", "%"+s+"%")
+		}
+		var endpoints []WebEndpoint
+		if err := tx.Find(&endpoints).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, e := range endpoints {
+			res = res + fmt.Sprintf("%s\t%d\t%s\t%s\t%s\n", e.Method, e.Status, e.URL, e.Params, e.ContentType)
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/web/{ip}/{port}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		var endpoints []WebEndpoint
+		if err := db.Where("ip = ? AND port = ?", mux.Vars(r)["ip"], mux.Vars(r)["port"]).Order("url, method, status").Find(&endpoints).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(siteMap(endpoints)))
+	}).Methods("GET")
+}
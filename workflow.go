@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusUntested = "untested"
+	StatusProgress = "progress"
+	StatusDone     = "done"
+	StatusNA       = "na"
+)
+
+var testStatuses = []string{StatusUntested, StatusProgress, StatusDone, StatusNA}
+
+func validStatus(status string) error {
+	for _, s := range testStatuses {
+		if s == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid status %q, use one of %s", status, strings.Join(testStatuses, ", "))
+}
+
+func statusClass(status string) string {
+	switch status {
+	case StatusProgress:
+		return "bg-warning text-dark"
+	case StatusDone:
+		return "bg-success"
+	case StatusNA:
+		return "bg-dark"
+	}
+	return "bg-secondary"
+}
+
+func statusBadge(status, assignee string) string {
+	if status == "" {
+		status = StatusUntested
+	}
+	badge := fmt.Sprintf(`<span class="badge %s">%s</span>`, statusClass(status), status)
+	if assignee != "" {
+		badge = badge + fmt.Sprintf(` <span class="badge bg-light text-dark">%s</span>`, template.HTMLEscapeString(assignee))
+	}
+	return badge
+}
+
+// statusFromForm applies the status and assignee fields present in the form.
+func statusFromForm(r *http.Request, status, assignee *string) error {
+	if _, ok := r.Form["status"]; ok {
+		s := strings.ToLower(strings.TrimSpace(r.FormValue("status")))
+		if err := validStatus(s); err != nil {
+			return err
+		}
+		*status = s
+	}
+	if _, ok := r.Form["assignee"]; ok {
+		*assignee = strings.TrimSpace(r.FormValue("assignee"))
+	}
+	return nil
+}
+
+type progressRow struct {
+	Assignee string
+	Hosts    map[string]int
+	Ports    map[string]int
+}
+
+func Progress(db *gorm.DB) ([]*progressRow, error) {
+	var counts []struct {
+		Assignee string
+		Status   string
+		Count    int
+	}
+	byAssignee := make(map[string]*progressRow)
+	row := func(assignee string) *progressRow {
+		p, ok := byAssignee[assignee]
+		if !ok {
+			p = &progressRow{Assignee: assignee, Hosts: make(map[string]int), Ports: make(map[string]int)}
+			byAssignee[assignee] = p
+		}
+		return p
+	}
+
+	err := db.Model(&Host{}).Select("assignee, status, COUNT(*) AS count").Group("assignee, status").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		row(c.Assignee).Hosts[c.Status] += c.Count
+	}
+	counts = nil
+	err = db.Model(&Port{}).Select("assignee, status, COUNT(*) AS count").Where("state = ?", "open").Group("assignee, status").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		row(c.Assignee).Ports[c.Status] += c.Count
+	}
+
+	var rows []*progressRow
+	for _, p := range byAssignee {
+		rows = append(rows, p)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Assignee < rows[j].Assignee })
+	return rows, nil
+}
+
+func formatProgress(counts map[string]int) string {
+	total := 0
+	var parts []string
+	for _, s := range testStatuses {
+		total += counts[s]
+		parts = append(parts, fmt.Sprintf("%s=%d", s, counts[s]))
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(parts, " "))
+}
+
+func WorkflowRouter(nmapRouter *mux.Router, db *gorm.DB) {
+
+	nmapRouter.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		rows, err := Progress(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ""
+		for _, p := range rows {
+			assignee := p.Assignee
+			if assignee == "" {
+				assignee = "unassigned"
+			}
+			res = res + fmt.Sprintf("%s\thosts %s\topen ports %s\n", assignee, formatProgress(p.Hosts), formatProgress(p.Ports))
+		}
+		w.Write([]byte(res))
+	}).Methods("GET")
+
+	nmapRouter.HandleFunc("/assign", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] ASSIGN [%s]: %s \n", r.RemoteAddr, r.Method, r.URL)
+		r.ParseForm()
+		cidrs, err := parseCidrs(r.FormValue("cidr"))
+		if err != nil || len(cidrs) == 0 {
+			http.Error(w, "missing or invalid cidr", http.StatusBadRequest)
+			return
+		}
+		var status, assignee string
+		if err := statusFromForm(r, &status, &assignee); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updates := make(map[string]any)
+		if _, ok := r.Form["status"]; ok {
+			updates["status"] = status
+		}
+		if _, ok := r.Form["assignee"]; ok {
+			updates["assignee"] = assignee
+		}
+		if len(updates) == 0 {
+			http.Error(w, "nothing to update, set status or assignee", http.StatusBadRequest)
+			return
+		}
+
+		var hosts []Host
+		if err := db.Select("id", "ip", "hostname").Find(&hosts).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q := &NmapQuery{Cidrs: cidrs}
+		var ids []uint
+		for _, host := range hosts {
+			if q.matchHost(host.IP, "") {
+				ids = append(ids, host.ID)
+			}
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for batch := ids; len(batch) > 0; {
+				n := min(len(batch), 500)
+				if err := tx.Model(&Host{}).Where("id IN ?", batch[:n]).Updates(updates).Error; err != nil {
+					return err
+				}
+				batch = batch[n:]
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("updated %d hosts \nOK\n", len(ids))))
+	}).Methods("POST")
+}